@@ -50,3 +50,27 @@ Selector labels
 app.kubernetes.io/name: {{ include "git-auth-proxy.name" . }}
 app.kubernetes.io/instance: {{ .Release.Name }}
 {{- end }}
+
+{{/*
+Name of the configuration file, configs given as an object are rendered as YAML
+*/}}
+{{- define "git-auth-proxy.configFile" -}}
+{{- if kindIs "map" .Values.config -}}
+config.yaml
+{{- else -}}
+config.{{ .Values.configFormat | default "json" }}
+{{- end }}
+{{- end }}
+
+{{/*
+Image of the proxy, the git variant is required by the mirror cache
+*/}}
+{{- define "git-auth-proxy.image" -}}
+{{- if .Values.image.tag -}}
+{{ .Values.image.repository }}:{{ .Values.image.tag }}
+{{- else if .Values.mirror.enabled -}}
+{{ .Values.image.repository }}:{{ .Chart.AppVersion }}-git
+{{- else -}}
+{{ .Values.image.repository }}:{{ .Chart.AppVersion }}
+{{- end }}
+{{- end }}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/spf13/afero"
+
+	"github.com/legobeat/git-auth-proxy/pkg/check"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+type CheckConfigCommand struct {
+	Strict bool `arg:"--strict" help:"exit non-zero if there are warnings"`
+}
+
+// checkConfig writes a report of the configuration and returns the exit code.
+func checkConfig(w io.Writer, fs afero.Fs, path string, cmd *CheckConfigCommand) int {
+	cfg, err := config.LoadConfiguration(fs, path, config.WithoutSecrets())
+	if err != nil {
+		//nolint: errcheck //ignore
+		fmt.Fprintf(w, "error: could not load configuration: %v\n", err)
+		return 1
+	}
+	findings := check.Configuration(cfg)
+	if err := check.WriteReport(w, cfg, findings); err != nil {
+		return 1
+	}
+	if check.HasErrors(findings) || (cmd.Strict && len(findings) > 0) {
+		return 1
+	}
+	return 0
+}
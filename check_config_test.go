@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfigUnresolvedSecrets(t *testing.T) {
+	content := `
+policies:
+  - id: dev
+    provider: github
+    github:
+      token: ${GIT_AUTH_PROXY_UNSET_TOKEN}
+    userAuth:
+      tokenHash: ${file:/var/secrets/missing}
+    repositories:
+      - owner: acme
+        name: fleet-infra
+`
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "config.yaml", []byte(content), 0o600))
+	b := &strings.Builder{}
+	require.Equal(t, 0, checkConfig(b, fs, "config.yaml", &CheckConfigCommand{Strict: true}), b.String())
+	require.Contains(t, b.String(), "1 policies, 0 errors, 0 warnings")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+type ExplainCommand struct {
+	Token  string `arg:"--token,env:GIT_AUTH_PROXY_TOKEN" help:"client token to authorize the request with"`
+	Policy string `arg:"--policy" help:"ID of the policy to evaluate the request against, restricts the token check to the policy if a token is set"`
+	Method string `arg:"positional,required" help:"method of the request"`
+	URL    string `arg:"positional,required" help:"URL of the request to the proxy, or only its path"`
+}
+
+// explain writes how the request would be authorized and sent upstream, and returns the exit code.
+// The exit code is zero if the request would be proxied.
+func explain(ctx context.Context, w io.Writer, fs afero.Fs, path string, cmd *ExplainCommand) int {
+	b := &strings.Builder{}
+	err := writeExplanation(ctx, b, fs, path, cmd)
+	if err != nil {
+		fmt.Fprintf(b, "denied: %v\n", err)
+	}
+	//nolint: errcheck //ignore
+	io.WriteString(w, b.String())
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func writeExplanation(ctx context.Context, b *strings.Builder, fs afero.Fs, path string, cmd *ExplainCommand) error {
+	if cmd.Token == "" && cmd.Policy == "" {
+		return errors.New("either a token or a policy is required")
+	}
+	cfg, err := config.LoadConfiguration(fs, path, config.WithoutSecrets())
+	if err != nil {
+		return fmt.Errorf("could not load configuration: %w", err)
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	if err != nil {
+		return fmt.Errorf("could not generate authorization: %w", err)
+	}
+	u, err := url.Parse(cmd.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	method := strings.ToUpper(cmd.Method)
+	requestURL := &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
+	if requestURL.Path == "" {
+		requestURL.Path = "/"
+	}
+
+	var endpoints []*auth.Endpoint
+	if cmd.Token != "" {
+		endpoints, err = authz.GetEndpointsByIdentity(auth.Identity{Token: cmd.Token, PolicyID: cmd.Policy})
+		if err != nil {
+			return err
+		}
+	} else {
+		endpoints = authz.GetEndpointsByPolicyID(cmd.Policy)
+		if len(endpoints) == 0 {
+			return fmt.Errorf("policy %s not found", cmd.Policy)
+		}
+	}
+
+	explanation := auth.Explain(endpoints, method, requestURL.EscapedPath())
+	writeDecisions(b, explanation)
+	e := explanation.Endpoint
+	if e == nil {
+		return fmt.Errorf("%w: %s %s is not permitted by any policy", auth.ErrNotPermitted, method, requestURL)
+	}
+	if e.IsRepositoryList(method, requestURL.EscapedPath()) {
+		fmt.Fprintf(b, "repository list: the upstream pages are filtered to the repositories of policy %s\n", e.ID())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, requestURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req, target, err := authz.UpdateRequest(ctx, req, e)
+	if err != nil {
+		return fmt.Errorf("could not update request: %w", err)
+	}
+	writeUpstreamRequest(b, req, target)
+	return nil
+}
+
+func writeDecisions(b *strings.Builder, explanation *auth.Explanation) {
+	for _, d := range explanation.Decisions {
+		switch {
+		case d.Permitted:
+			fmt.Fprintf(b, "policy %s: permitted by %s\n", d.Endpoint.ID(), d.Rule)
+		case d.Rule != "":
+			fmt.Fprintf(b, "policy %s: denied by %s\n", d.Endpoint.ID(), d.Rule)
+		default:
+			fmt.Fprintf(b, "policy %s: denied, no rule matched\n", d.Endpoint.ID())
+		}
+	}
+	switch {
+	case explanation.Endpoint == nil:
+	case explanation.Audit:
+		fmt.Fprintf(b, "allowed: policy %s would deny the request but is in audit mode\n", explanation.Endpoint.ID())
+	default:
+		fmt.Fprintf(b, "allowed: policy %s\n", explanation.Endpoint.ID())
+	}
+}
+
+// writeUpstreamRequest writes the upstream URL and the scheme of the upstream credentials, but never the credentials.
+func writeUpstreamRequest(b *strings.Builder, req *http.Request, target *url.URL) {
+	fmt.Fprintf(b, "upstream: %s %s://%s%s\n", req.Method, target.Scheme, req.Host, req.URL.RequestURI())
+	scheme, _, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+	if scheme == "" {
+		b.WriteString("authorization: none\n")
+		return
+	}
+	fmt.Fprintf(b, "authorization: %s with upstream credential %s\n", scheme, auth.UpstreamCredentialLabel(req.Context()))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net/http"
@@ -18,49 +19,156 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/afero"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
+	"github.com/legobeat/git-auth-proxy/pkg/audit"
 	"github.com/legobeat/git-auth-proxy/pkg/auth"
 	"github.com/legobeat/git-auth-proxy/pkg/config"
+	"github.com/legobeat/git-auth-proxy/pkg/httpcache"
+	"github.com/legobeat/git-auth-proxy/pkg/mirror"
+	"github.com/legobeat/git-auth-proxy/pkg/redact"
 	"github.com/legobeat/git-auth-proxy/pkg/server"
+	"github.com/legobeat/git-auth-proxy/pkg/tracing"
 )
 
 type Arguments struct {
-	Addr        string `arg:"--addr" default:":8080"`
-	MetricsAddr string `arg:"--metrics-addr" default:":9090"`
-	CfgPath     string `arg:"--config,required"`
+	CheckConfig  *CheckConfigCommand  `arg:"subcommand:check-config" help:"check the configuration and report problems without running the proxy"`
+	Explain      *ExplainCommand      `arg:"subcommand:explain" help:"explain how a request would be authorized and sent upstream without contacting the upstream"`
+	TestPolicies *TestPoliciesCommand `arg:"subcommand:test-policies" help:"evaluate files of test cases against the policies"`
+	Token        *TokenCommand        `arg:"subcommand:token" help:"generate and verify client tokens"`
+
+	Addr        string        `arg:"--addr" default:":8080"`
+	MetricsAddr string        `arg:"--metrics-addr" default:":9090"`
+	CfgPath     string        `arg:"--config" help:"path to the configuration file"`
+	TLSCert     string        `arg:"--tls-cert" help:"path to the certificate used to serve TLS"`
+	TLSKey      string        `arg:"--tls-key" help:"path to the private key used to serve TLS"`
+	TLSClientCA string        `arg:"--tls-client-ca" help:"path to a CA bundle used to verify client certificates"`
+	TLSReload   time.Duration `arg:"--tls-reload-interval" default:"30s" help:"interval at which the TLS certificate is checked for changes, 0 disables reloading"`
+	MetricsTLS  bool          `arg:"--metrics-tls" help:"serve metrics over TLS with the TLS certificate"`
+	AuditLog    string        `arg:"--audit-log" default:"-" help:"file to append audit events to as JSON lines, - writes to stdout and an empty value disables the audit log"`
+
+	OTLPEndpoint     string  `arg:"--otlp-endpoint" help:"OTLP/HTTP endpoint URL to export traces to, tracing is disabled if empty"`
+	OTLPInsecure     bool    `arg:"--otlp-insecure" help:"export traces without TLS"`
+	TraceSampleRatio float64 `arg:"--trace-sample-ratio" default:"1" help:"ratio of traces sampled unless the client decided whether to sample"`
+
+	UsernameAsPolicyID bool     `arg:"--username-as-policy-id" help:"use the username of basic credentials as the ID of the policy to check the token against"`
+	TrustedProxies     []string `arg:"--trusted-proxies" help:"networks whose X-Forwarded-For headers are trusted to determine the client IP"`
+	ExternalURL        string   `arg:"--external-url" help:"URL clients use to reach the proxy, upstream URLs in responses are rewritten to it, derived from the request if empty"`
+
+	RepositoryListMaxPages int           `arg:"--repository-list-max-pages" default:"10" help:"maximum number of upstream pages fetched to filter a repository list"`
+	RepositoryListCacheTTL time.Duration `arg:"--repository-list-cache-ttl" default:"1m" help:"duration filtered repository lists are cached for, 0 disables the cache"`
+	StripResponseHeaders   []string      `arg:"--strip-response-headers" help:"upstream response headers to remove instead of the default deny-list, a trailing * matches any header with the prefix"`
+
+	AuthFailureThreshold int           `arg:"--auth-failure-threshold" default:"10" help:"failed authentication attempts after which a client is locked out, 0 disables lockouts"`
+	AuthFailureBaseDelay time.Duration `arg:"--auth-failure-base-delay" default:"1s" help:"duration of the first lockout, doubled for every further failure"`
+	AuthFailureMaxDelay  time.Duration `arg:"--auth-failure-max-delay" default:"15m" help:"maximum lockout duration"`
+	AuthFailureWindow    time.Duration `arg:"--auth-failure-window" default:"15m" help:"duration after which failed authentication attempts are forgotten"`
+	AuthFailureByIP      *bool         `arg:"--auth-failure-by-ip" help:"lock out client IPs after failed authentication attempts, enabled by default only if --trusted-proxies is set"`
+
+	UpstreamMaxIdleConns          int           `arg:"--upstream-max-idle-conns" default:"100" help:"maximum number of idle upstream connections"`
+	UpstreamMaxIdleConnsPerHost   int           `arg:"--upstream-max-idle-conns-per-host" default:"100" help:"maximum number of idle connections per upstream host"`
+	UpstreamMaxConnsPerHost       int           `arg:"--upstream-max-conns-per-host" default:"0" help:"maximum number of connections per upstream host, 0 is unlimited"`
+	UpstreamIdleConnTimeout       time.Duration `arg:"--upstream-idle-conn-timeout" default:"90s" help:"duration after which idle upstream connections are closed"`
+	UpstreamKeepAlive             time.Duration `arg:"--upstream-keep-alive" default:"30s" help:"interval of TCP keep-alive probes, negative disables keep-alives"`
+	UpstreamDialTimeout           time.Duration `arg:"--upstream-dial-timeout" default:"30s" help:"timeout for establishing upstream connections"`
+	UpstreamTLSHandshakeTimeout   time.Duration `arg:"--upstream-tls-handshake-timeout" default:"10s" help:"timeout for upstream TLS handshakes"`
+	UpstreamResponseHeaderTimeout time.Duration `arg:"--upstream-response-header-timeout" default:"0s" help:"timeout for receiving upstream response headers, 0 is no timeout"`
+	UpstreamHTTP2                 bool          `arg:"--upstream-http2" default:"true" help:"attempt to use HTTP/2 for upstream connections"`
+	UpstreamBufferSize            int           `arg:"--upstream-buffer-size" default:"32768" help:"size of the pooled buffers used to copy response bodies"`
+
+	MirrorDir             string        `arg:"--mirror-dir" help:"directory to keep bare mirrors in, enables serving fetches and clones from local mirrors"`
+	MirrorTTL             time.Duration `arg:"--mirror-ttl" default:"1m" help:"age after which a mirror is fetched from the upstream when a client fetches"`
+	MirrorRefreshInterval time.Duration `arg:"--mirror-refresh-interval" default:"0s" help:"interval at which all mirrors are fetched in the background, 0 disables background fetches"`
+	MirrorFetchTimeout    time.Duration `arg:"--mirror-fetch-timeout" default:"5m" help:"timeout for fetching a mirror from the upstream"`
+
+	ResponseCache            bool   `arg:"--response-cache" help:"cache API responses and revalidate them with conditional requests"`
+	ResponseCacheDir         string `arg:"--response-cache-dir" help:"directory to persist cached API responses in, responses are only kept in memory if empty"`
+	ResponseCacheMaxEntries  int    `arg:"--response-cache-max-entries" default:"10000" help:"maximum number of API responses kept in memory"`
+	ResponseCacheDirMaxSize  int64  `arg:"--response-cache-dir-max-size" default:"104857600" help:"maximum size in bytes of the responses persisted in the directory"`
+	ResponseCacheMaxBodySize int64  `arg:"--response-cache-max-body-size" default:"1048576" help:"largest API response body in bytes which is cached"`
 }
 
 func main() {
 	args := &Arguments{}
-	arg.MustParse(args)
-
-	zapLog, err := zap.NewProduction()
-	if err != nil {
-		panic(fmt.Sprintf("who watches the watchmen (%v)?", err))
+	p := arg.MustParse(args)
+	if args.Token != nil {
+		os.Exit(token(os.Stdin, os.Stdout, args.Token))
+	}
+	if args.CfgPath == "" {
+		p.Fail("--config is required")
+	}
+	if args.CheckConfig != nil {
+		os.Exit(checkConfig(os.Stdout, afero.NewOsFs(), args.CfgPath, args.CheckConfig))
+	}
+	if args.Explain != nil {
+		os.Exit(explain(context.Background(), os.Stdout, afero.NewOsFs(), args.CfgPath, args.Explain))
 	}
-	log := zapr.NewLogger(zapLog)
+	if args.TestPolicies != nil {
+		os.Exit(testPolicies(os.Stdout, afero.NewOsFs(), args.CfgPath, args.TestPolicies))
+	}
+
+	redactor := redact.NewRedactor()
+	log := zapr.NewLogger(newLogger(redactor))
 	ctx := logr.NewContext(context.Background(), log)
 
-	if err := run(ctx, args.Addr, args.MetricsAddr, args.CfgPath); err != nil {
+	if err := run(ctx, args, redactor); err != nil {
 		log.Error(err, "")
 		os.Exit(1)
 	}
 	log.Info("gracefully shutdown")
 }
 
-func run(ctx context.Context, addr, metricsAddr, cfgPath string) error {
-	authz, err := getAutorization(cfgPath)
+func run(ctx context.Context, args *Arguments, redactor *redact.Redactor) error {
+	authz, err := getAutorization(args.CfgPath)
 	if err != nil {
 		return err
 	}
+	redactor.AddSecrets(authz.UpstreamTokens()...)
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		Endpoint:    args.OTLPEndpoint,
+		Insecure:    args.OTLPInsecure,
+		SampleRatio: args.TraceSampleRatio,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		//nolint: errcheck //ignore
+		shutdownTracing(shutdownCtx)
+	}()
+	reloader, err := getCertificateReloader(args)
+	if err != nil {
+		return err
+	}
+	var tlsCfg, metricsTLSCfg *tls.Config
+	if reloader != nil {
+		tlsCfg, err = server.NewTLSConfig(reloader, args.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("could not create TLS configuration: %w", err)
+		}
+		if args.MetricsTLS {
+			metricsTLSCfg, err = server.NewTLSConfig(reloader, "")
+			if err != nil {
+				return fmt.Errorf("could not create metrics TLS configuration: %w", err)
+			}
+		}
+	}
 
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM)
 	defer cancel()
 	g, ctx := errgroup.WithContext(ctx)
 
-	metricsSrv := &http.Server{ReadTimeout: 5 * time.Second, Addr: metricsAddr, Handler: promhttp.Handler()}
+	if reloader != nil {
+		g.Go(func() error {
+			return reloader.Run(ctx, args.TLSReload)
+		})
+	}
+
+	metricsSrv := &http.Server{ReadTimeout: 5 * time.Second, Addr: args.MetricsAddr, Handler: promhttp.Handler(), TLSConfig: metricsTLSCfg}
 	g.Go(func() error {
-		if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := listenAndServe(metricsSrv); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
 		return nil
@@ -72,10 +180,79 @@ func run(ctx context.Context, addr, metricsAddr, cfgPath string) error {
 		return metricsSrv.Shutdown(shutdownCtx)
 	})
 
-	gp := server.NewGitProxy(authz)
-	proxySrv := gp.Server(ctx, addr)
+	proxyCfg := server.DefaultConfig()
+	proxyCfg.UsernameAsPolicyID = args.UsernameAsPolicyID
+	proxyCfg.TrustedProxies = args.TrustedProxies
+	proxyCfg.ExternalURL = args.ExternalURL
+	proxyCfg.RepositoryListMaxPages = args.RepositoryListMaxPages
+	proxyCfg.RepositoryListCacheTTL = args.RepositoryListCacheTTL
+	if len(args.StripResponseHeaders) > 0 {
+		proxyCfg.StripResponseHeaders = args.StripResponseHeaders
+	}
+	proxyCfg.Lockout = server.LockoutConfig{
+		Threshold: args.AuthFailureThreshold,
+		BaseDelay: args.AuthFailureBaseDelay,
+		MaxDelay:  args.AuthFailureMaxDelay,
+		Window:    args.AuthFailureWindow,
+		// Behind a proxy which is not trusted all clients share its IP and would be locked out together
+		ByIP: len(args.TrustedProxies) > 0,
+	}
+	if args.AuthFailureByIP != nil {
+		proxyCfg.Lockout.ByIP = *args.AuthFailureByIP
+	}
+	proxyCfg.Transport = server.TransportConfig{
+		MaxIdleConns:          args.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   args.UpstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:       args.UpstreamMaxConnsPerHost,
+		IdleConnTimeout:       args.UpstreamIdleConnTimeout,
+		KeepAlive:             args.UpstreamKeepAlive,
+		DialTimeout:           args.UpstreamDialTimeout,
+		TLSHandshakeTimeout:   args.UpstreamTLSHandshakeTimeout,
+		ResponseHeaderTimeout: args.UpstreamResponseHeaderTimeout,
+		HTTP2:                 args.UpstreamHTTP2,
+		BufferSize:            args.UpstreamBufferSize,
+	}
+	if args.MirrorDir != "" {
+		mirrorCache, err := mirror.NewCache(mirror.Config{
+			Dir:             args.MirrorDir,
+			TTL:             args.MirrorTTL,
+			RefreshInterval: args.MirrorRefreshInterval,
+			FetchTimeout:    args.MirrorFetchTimeout,
+		})
+		if err != nil {
+			return err
+		}
+		proxyCfg.Mirror = mirrorCache
+		g.Go(func() error {
+			return mirrorCache.Run(ctx)
+		})
+	}
+	if args.ResponseCache {
+		proxyCfg.ResponseCache, err = getResponseCache(args)
+		if err != nil {
+			return err
+		}
+		proxyCfg.ResponseCacheMaxBodySize = args.ResponseCacheMaxBodySize
+	}
+	if args.AuditLog != "" {
+		auditLog, closer, err := audit.Open(args.AuditLog)
+		if err != nil {
+			return err
+		}
+		//nolint: errcheck //ignore
+		defer closer.Close()
+		proxyCfg.Audit = auditLog
+	}
+	gp, err := server.NewGitProxy(authz, proxyCfg)
+	if err != nil {
+		return err
+	}
+	proxySrv, err := gp.Server(ctx, args.Addr, tlsCfg)
+	if err != nil {
+		return err
+	}
 	g.Go(func() error {
-		if err := proxySrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := listenAndServe(proxySrv); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			return err
 		}
 		return nil
@@ -94,6 +271,15 @@ func run(ctx context.Context, addr, metricsAddr, cfgPath string) error {
 	return nil
 }
 
+// newLogger returns a production logger which redacts credentials from all entries.
+func newLogger(redactor *redact.Redactor) *zap.Logger {
+	cfg := zap.NewProductionConfig()
+	enc := redact.NewEncoder(zapcore.NewJSONEncoder(cfg.EncoderConfig), redactor)
+	core := zapcore.NewCore(enc, zapcore.Lock(os.Stderr), cfg.Level)
+	core = zapcore.NewSamplerWithOptions(core, time.Second, cfg.Sampling.Initial, cfg.Sampling.Thereafter)
+	return zap.New(core, zap.AddCaller(), zap.AddStacktrace(zapcore.ErrorLevel), zap.ErrorOutput(zapcore.Lock(os.Stderr)))
+}
+
 func getAutorization(path string) (*auth.Authorizer, error) {
 	cfg, err := config.LoadConfiguration(afero.NewOsFs(), path)
 	if err != nil {
@@ -105,3 +291,43 @@ func getAutorization(path string) (*auth.Authorizer, error) {
 	}
 	return authz, nil
 }
+
+func getCertificateReloader(args *Arguments) (*server.CertificateReloader, error) {
+	if args.TLSCert == "" && args.TLSKey == "" {
+		if args.TLSClientCA != "" || args.MetricsTLS {
+			return nil, errors.New("TLS options require a TLS certificate and key")
+		}
+		return nil, nil
+	}
+	if args.TLSCert == "" || args.TLSKey == "" {
+		return nil, errors.New("both TLS certificate and key have to be set")
+	}
+	if args.TLSReload < 0 {
+		return nil, errors.New("TLS reload interval cannot be negative")
+	}
+	reloader, err := server.NewCertificateReloader(args.TLSCert, args.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	return reloader, nil
+}
+
+func getResponseCache(args *Arguments) (httpcache.Store, error) {
+	memory := httpcache.NewMemoryStore(args.ResponseCacheMaxEntries)
+	if args.ResponseCacheDir == "" {
+		return memory, nil
+	}
+	disk, err := httpcache.NewDiskStore(args.ResponseCacheDir, args.ResponseCacheDirMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	return &httpcache.TieredStore{First: memory, Second: disk}, nil
+}
+
+// listenAndServe serves TLS if the server has a TLS configuration.
+func listenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,85 @@
+// Package audit writes an audit event for every request and security relevant decision as JSON lines.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// TypeRequest is the event of an authorization decision for a request.
+	TypeRequest = "request"
+	// TypeLockout is the event of a client being locked out after failed authentication attempts.
+	TypeLockout = "lockout"
+)
+
+// Event is a single audit event. Credentials are only identified by their labels, never by their secrets.
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	ClientIP string    `json:"clientIP,omitempty"`
+	// Username is the username presented by the client, if any.
+	Username string `json:"username,omitempty"`
+	// Auth is how the client was authenticated, anonymous, token, certificate or none.
+	Auth string `json:"auth,omitempty"`
+	// Policy is the ID of the policy which authorized the request.
+	Policy string `json:"policy,omitempty"`
+	// Credential is the label of the upstream credential the request was sent with.
+	Credential string `json:"credential,omitempty"`
+	Method     string `json:"method,omitempty"`
+	Path       string `json:"path,omitempty"`
+	// Service is the git service, or api, graphql or download for other requests.
+	Service    string `json:"service,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Decision   string `json:"decision,omitempty"`
+	Reason     string `json:"reason,omitempty"`
+	// UpstreamStatus is the status of the response returned to the client for requests which were allowed.
+	UpstreamStatus int `json:"upstreamStatus,omitempty"`
+	// LockedFor is the duration of a lockout.
+	LockedFor string `json:"lockedFor,omitempty"`
+}
+
+// Logger writes audit events as JSON lines. A nil Logger discards all events.
+type Logger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	now func() time.Time
+}
+
+func NewLogger(w io.Writer) *Logger {
+	return &Logger{
+		enc: json.NewEncoder(w),
+		now: time.Now,
+	}
+}
+
+// Open returns a logger appending to the file at the path, or writing to stdout if the path is "-".
+// The returned closer has to be closed when the logger is no longer used.
+func Open(path string) (*Logger, io.Closer, error) {
+	if path == "-" {
+		return NewLogger(os.Stdout), io.NopCloser(nil), nil
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open audit log: %w", err)
+	}
+	return NewLogger(f), f, nil
+}
+
+// Log writes the event, the time is set if it is zero.
+func (l *Logger) Log(e *Event) {
+	if l == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = l.now().UTC()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	//nolint: errcheck //ignore
+	l.enc.Encode(e)
+}
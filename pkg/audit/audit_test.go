@@ -0,0 +1,35 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(buf)
+	l.now = func() time.Time {
+		return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+	l.Log(&Event{Type: TypeRequest, ClientIP: "10.0.0.1", Policy: "github.com//dev", Decision: "allowed", UpstreamStatus: 200})
+	l.Log(&Event{Type: TypeLockout, Username: "ci", LockedFor: "1s"})
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	require.JSONEq(t, `{"time":"2024-01-02T03:04:05Z","type":"request","clientIP":"10.0.0.1","policy":"github.com//dev","decision":"allowed","upstreamStatus":200}`, string(lines[0]))
+	event := &Event{}
+	require.NoError(t, json.Unmarshal(lines[1], event))
+	require.Equal(t, TypeLockout, event.Type)
+	require.Equal(t, "ci", event.Username)
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+	require.NotPanics(t, func() {
+		l.Log(&Event{Type: TypeRequest})
+	})
+}
@@ -2,47 +2,104 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"regexp"
+	"slices"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
-	"github.com/go-crypt/crypt"
 	"github.com/legobeat/git-auth-proxy/pkg/config"
 )
 
+var tracer = otel.Tracer("github.com/legobeat/git-auth-proxy/pkg/auth")
+
 type Provider interface {
 	getPathRegex(owner, repository string) ([]*regexp.Regexp, error)
 	getAuthorizationHeader(ctx context.Context, path string) (string, error)
 	getHost(e *Endpoint, path string) string
 	getPath(e *Endpoint, path string) string
+	getRepositoryListRegex() *regexp.Regexp
+	getDownloadHosts(host string) []string
+	getProxyPath(e *Endpoint, u *url.URL) (string, bool)
+}
+
+var (
+	// ErrNotAuthenticated is returned when no policy matches the client credentials.
+	ErrNotAuthenticated = errors.New("not authenticated")
+	// ErrNotPermitted is returned when the matching policies do not permit the request.
+	ErrNotPermitted = errors.New("not permitted")
+	// ErrAuditDenied is returned together with an endpoint in audit mode when the request would be denied
+	// if the endpoint was enforced. Callers which do not support audit mode deny the request.
+	ErrAuditDenied = errors.New("denied in audit mode")
+)
+
+// Identity contains the credentials presented by a client.
+type Identity struct {
+	// Token is the client token, empty if none was presented.
+	Token string
+	// PolicyID restricts the token check to the policy with the given ID, if set.
+	PolicyID string
+	// Certificate is the verified TLS client certificate, nil if none was presented.
+	Certificate *x509.Certificate
 }
 
 type Authorizer struct {
-	providers        map[string]Provider
-	endpoints        []*Endpoint
-	endpointsByID    map[string]*Endpoint
-	endpointsByToken map[string]*Endpoint
+	providers      map[string]Provider
+	upstreamTokens []string
+	endpoints      []*Endpoint
+	endpointsByID  map[string]*Endpoint
+	verifications  *verificationCache
 }
 
 func NewAuthorizer(cfg *config.Configuration) (*Authorizer, error) {
 	providers := map[string]Provider{}
 	endpoints := []*Endpoint{}
 	endpointsByID := map[string]*Endpoint{}
-	endpointsByToken := map[string]*Endpoint{}
+	// Credentials are shared by policies using the same upstream token so that their rate limit is tracked once
+	credentials := map[string]*upstreamCredential{}
+	upstreamTokens := []string{}
+	// Download paths signed by the proxy are only valid until it restarts
+	downloadKey := make([]byte, 32)
+	if _, err := rand.Read(downloadKey); err != nil {
+		return nil, fmt.Errorf("could not generate download signing key: %w", err)
+	}
 
 	for _, p := range cfg.Policies {
 		// Get the correct provider for the policy
 		var provider Provider
 		switch p.Provider {
 		case config.GitHubProviderType:
-			ghToken := p.GitHub.Token
-			provider = newGithub(ghToken)
+			pool := []*upstreamCredential{}
+			for i, token := range p.GitHub.GetTokens() {
+				c, ok := credentials[token]
+				if !ok {
+					if token != "" {
+						upstreamTokens = append(upstreamTokens, token)
+					}
+					c = newUpstreamCredential(fmt.Sprintf("%s/%d", p.ID, i), githubDummyTokenSource{token: token})
+					credentials[token] = c
+				}
+				pool = append(pool, c)
+			}
+			provider = newGithub(newTokenPool(pool))
 		default:
 			return nil, fmt.Errorf("invalid provider type %s", p.Provider)
 		}
 
+		if p.Mode == config.PolicyModeAudit && p.UserAuth.Anonymous {
+			return nil, fmt.Errorf("anonymous policy %s cannot use audit mode", p.ID)
+		}
+
 		regexes := make([]*regexp.Regexp, 0)
+		regexRules := []string{}
 
 		// Create endpoint for the repositories
 		for _, r := range p.Repositories {
@@ -52,29 +109,57 @@ func NewAuthorizer(cfg *config.Configuration) (*Authorizer, error) {
 			}
 
 			regexes = append(regexes, pathRegex...)
+			for range pathRegex {
+				regexRules = append(regexRules, fmt.Sprintf("repository %s/%s", r.Owner, r.Name))
+			}
+		}
+		apiRoutes := []apiRoute{}
+		for _, r := range p.APIRoutes {
+			route, err := parseAPIRoute(r)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse api route of policy %s: %w", p.ID, err)
+			}
+			apiRoutes = append(apiRoutes, route)
 		}
 		e := &Endpoint{
-			host:      p.Host,
-			scheme:    p.Scheme,
-			id:        p.ID,
-			regexes:   regexes,
-			TokenHash: p.UserAuth.TokenHash,
+			host:          p.Host,
+			scheme:        p.Scheme,
+			id:            p.ID,
+			regexes:       regexes,
+			regexRules:    regexRules,
+			repositories:  p.Repositories,
+			listRegex:     provider.getRepositoryListRegex(),
+			apiRoutes:     apiRoutes,
+			downloadHosts: provider.getDownloadHosts(p.Host),
+			downloadKey:   downloadKey,
+			clientCert:    p.UserAuth.ClientCert,
+			anonymous:     p.UserAuth.Anonymous,
+			readOnly:      p.ReadOnly || p.UserAuth.Anonymous,
+			audit:         p.Mode == config.PolicyModeAudit,
+			rateLimit:     p.RateLimit,
+			upstream:      p.Upstream,
+			TokenHash:     p.UserAuth.TokenHash,
 		}
 		providers[e.ID()] = provider
 		endpoints = append(endpoints, e)
 		endpointsByID[e.ID()] = e
-		endpointsByToken[p.UserAuth.TokenHash] = e
 	}
 
 	authz := &Authorizer{
-		providers:        providers,
-		endpoints:        endpoints,
-		endpointsByID:    endpointsByID,
-		endpointsByToken: endpointsByToken,
+		providers:      providers,
+		upstreamTokens: upstreamTokens,
+		endpoints:      endpoints,
+		endpointsByID:  endpointsByID,
+		verifications:  newVerificationCache(verificationCacheTTL, verificationCacheMaxEntries),
 	}
 	return authz, nil
 }
 
+// UpstreamTokens returns the configured upstream tokens, which must never be disclosed to clients.
+func (a *Authorizer) UpstreamTokens() []string {
+	return a.upstreamTokens
+}
+
 func (a *Authorizer) GetEndpoints() []*Endpoint {
 	return a.endpoints
 }
@@ -88,82 +173,116 @@ func (a *Authorizer) GetEndpointById(id string) (*Endpoint, error) {
 }
 
 func (a *Authorizer) GetEndpointByToken(token string) (*Endpoint, error) {
-	var fallbackEndpoint *Endpoint
-	for tokenHash, e := range a.endpointsByToken {
-		// empty hash = anon policy. skip CheckPassword.
-		if tokenHash == "" {
-			fallbackEndpoint = e
-			if token == "" {
-				break
+	endpoints, err := a.GetEndpointsByIdentity(Identity{Token: token})
+	if err != nil {
+		return nil, err
+	}
+	return endpoints[0], nil
+}
+
+// GetEndpointsByIdentity returns all endpoints matching the identity. Endpoints selected
+// by the client certificate are ordered before endpoints selected by the token, followed
+// by the anonymous endpoints. Anonymous endpoints are never returned for an invalid token.
+func (a *Authorizer) GetEndpointsByIdentity(id Identity) ([]*Endpoint, error) {
+	return a.getEndpointsByIdentity(context.Background(), id)
+}
+
+func (a *Authorizer) getEndpointsByIdentity(ctx context.Context, id Identity) ([]*Endpoint, error) {
+	endpoints := []*Endpoint{}
+	if id.Certificate != nil {
+		for _, e := range a.endpoints {
+			if e.MatchesCertificate(id.Certificate) {
+				endpoints = append(endpoints, e)
 			}
-			continue
-		}
-		valid, err := crypt.CheckPassword(token, tokenHash)
-		if err != nil {
-			panic(err)
 		}
-		if valid {
-			return e, nil
+	}
+	if id.Token != "" {
+		tokenEndpoints, err := a.getEndpointsByToken(ctx, id.Token, id.PolicyID)
+		if err != nil && len(endpoints) == 0 {
+			return nil, err
 		}
+		endpoints = append(endpoints, tokenEndpoints...)
 	}
-	if fallbackEndpoint != nil {
-		return fallbackEndpoint, nil
+	for _, e := range a.endpoints {
+		if e.IsAnonymous() {
+			endpoints = append(endpoints, e)
+		}
 	}
-	if token == "" {
-		return nil, fmt.Errorf("missing basic auth")
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("%w: missing basic auth", ErrNotAuthenticated)
 	}
-	return nil, fmt.Errorf("endpoint not found for given token")
+	return endpoints, nil
 }
-func (a *Authorizer) GetRegexesByToken(token string) ([]*regexp.Regexp, error) {
-	regexes := make([]*regexp.Regexp, 0)
-	for tokenHash, e := range a.endpointsByToken {
-		// empty hash = anon policy. skip CheckPassword.
-		if tokenHash == "" {
-			regexes = append(regexes, e.regexes...)
-			if token == "" {
-				break
-			}
+
+// getEndpointsByToken returns the endpoints whose token hash matches the token.
+// Only the policy with the given ID is checked if set.
+func (a *Authorizer) getEndpointsByToken(ctx context.Context, token, policyID string) ([]*Endpoint, error) {
+	endpoints := []*Endpoint{}
+	for _, e := range a.endpoints {
+		if e.TokenHash == "" || (policyID != "" && e.id != policyID) {
 			continue
 		}
-		valid, err := crypt.CheckPassword(token, tokenHash)
+		valid, err := a.verifications.check(ctx, token, e.TokenHash)
 		if err != nil {
 			panic(err)
 		}
 		if valid {
-			regexes = append(regexes, e.regexes...)
+			endpoints = append(endpoints, e)
 		}
 	}
-	if len(regexes) > 0 {
-		return regexes, nil
-	}
-	if token == "" {
-		return nil, fmt.Errorf("missing basic auth")
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("%w: endpoint not found for given token", ErrNotAuthenticated)
 	}
-	return nil, fmt.Errorf("endpoint not found for given token")
+	return endpoints, nil
 }
 
-func (a *Authorizer) IsPermitted(path string, token string) error {
-	regexes, err := a.GetRegexesByToken(token)
+// Authorize returns the first endpoint matching the identity which permits the request.
+// If none does, the first matching endpoint in audit mode is returned with ErrAuditDenied.
+func (a *Authorizer) Authorize(ctx context.Context, id Identity, method, path string) (*Endpoint, error) {
+	ctx, span := tracer.Start(ctx, "Authorize")
+	defer span.End()
+	endpoints, err := a.getEndpointsByIdentity(ctx, id)
 	if err != nil {
-		return err
+		recordError(span, err)
+		return nil, err
 	}
-	if path == "/" && len(regexes) > 0 {
-		return nil
+	e, audit := evaluate(endpoints, method, path, nil)
+	switch {
+	case e != nil && audit:
+		span.SetAttributes(attribute.String("policy", e.ID()), attribute.Bool("audit", true))
+		return e, fmt.Errorf("%w: %s %s not permitted by %s", ErrAuditDenied, method, path, e.ID())
+	case e != nil:
+		span.SetAttributes(attribute.String("policy", e.ID()))
+		return e, nil
 	}
-	for _, r := range regexes {
-		if r.MatchString(path) {
-			return nil
-		}
-	}
-	return fmt.Errorf("token not permitted for path %s", path)
+	err = fmt.Errorf("%w: token not permitted for %s %s", ErrNotPermitted, method, path)
+	recordError(span, err)
+	return nil, err
 }
 
-func (a *Authorizer) UpdateRequest(ctx context.Context, req *http.Request, token string) (*http.Request, *url.URL, error) {
-	req.Header.Del("Authorization")
-	e, err := a.GetEndpointByToken(token)
+func (a *Authorizer) IsPermitted(method, path, token string) error {
+	_, err := a.Authorize(context.Background(), Identity{Token: token}, method, path)
+	return err
+}
+
+// UpdateRequest rewrites the request to target the upstream of the endpoint and replaces
+// the client credentials with the upstream credentials.
+func (a *Authorizer) UpdateRequest(ctx context.Context, req *http.Request, e *Endpoint) (*http.Request, *url.URL, error) {
+	spanCtx, span := tracer.Start(ctx, "UpdateRequest", trace.WithAttributes(attribute.String("policy", e.ID())))
+	defer span.End()
+	req, target, err := a.updateRequest(spanCtx, req, e)
 	if err != nil {
+		recordError(span, err)
 		return nil, nil, err
 	}
+	// The request outlives the span, the upstream request is a sibling of the span instead of its child
+	return req.WithContext(trace.ContextWithSpan(req.Context(), trace.SpanFromContext(ctx))), target, nil
+}
+
+func (a *Authorizer) updateRequest(ctx context.Context, req *http.Request, e *Endpoint) (*http.Request, *url.URL, error) {
+	req.Header.Del("Authorization")
+	ctx, _ = withUpstreamRequest(ctx)
+	req = req.WithContext(ctx)
 	provider, ok := a.providers[e.ID()]
 	if !ok {
 		return nil, nil, fmt.Errorf("provider not found for id %s", e.ID())
@@ -171,6 +290,20 @@ func (a *Authorizer) UpdateRequest(ctx context.Context, req *http.Request, token
 
 	host := provider.getHost(e, req.URL.Path)
 	path := provider.getPath(e, req.URL.Path)
+	downloadHost, downloadPath, download := splitDownloadPath(req.URL.Path)
+	if download {
+		if !slices.Contains(e.downloadHosts, downloadHost) {
+			return nil, nil, fmt.Errorf("download host %s not allowed for id %s", downloadHost, e.ID())
+		}
+		host = downloadHost
+		path = downloadPath
+		if isSignedDownloadHost(downloadHost) {
+			var signed bool
+			if _, path, signed = cutDownloadSignature(downloadPath); !signed {
+				return nil, nil, fmt.Errorf("download path of %s is not signed for id %s", downloadHost, e.ID())
+			}
+		}
+	}
 	url, err := url.Parse(fmt.Sprintf("%s://%s", e.scheme, host))
 	if err != nil {
 		return nil, nil, fmt.Errorf("invalid url format: %w", err)
@@ -179,8 +312,13 @@ func (a *Authorizer) UpdateRequest(ctx context.Context, req *http.Request, token
 	req.Host = host
 	req.URL.Path = path
 
+	// Download URLs are signed by the upstream and must not receive the upstream credentials
+	if download {
+		return req, url, nil
+	}
 	authorizationHeader, err := provider.getAuthorizationHeader(ctx, req.URL.Path)
 	if err != nil {
+		tokenSourceErrorsTotal.WithLabelValues(e.ID()).Inc()
 		return nil, nil, err
 	}
 	if authorizationHeader != "" {
@@ -188,3 +326,19 @@ func (a *Authorizer) UpdateRequest(ctx context.Context, req *http.Request, token
 	}
 	return req, url, nil
 }
+
+// ProxyPath returns the path on the proxy which is proxied to the upstream URL of the endpoint.
+// It returns false if the URL does not belong to the upstream of the endpoint.
+func (a *Authorizer) ProxyPath(e *Endpoint, u *url.URL) (string, bool) {
+	provider, ok := a.providers[e.ID()]
+	if !ok {
+		return "", false
+	}
+	return provider.getProxyPath(e, u)
+}
+
+// recordError marks the span as failed.
+func recordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func getCertificateAuthorizer() *Authorizer {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:       "subject",
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Repositories: []*config.Repository{
+					{
+						Owner: "org",
+						Name:  "subject",
+					},
+				},
+				UserAuth: config.UserAuth{
+					ClientCert: &config.ClientCert{
+						Subject: "CN=flux,O=acme",
+					},
+				},
+			},
+			{
+				ID:       "spiffe",
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Repositories: []*config.Repository{
+					{
+						Owner: "org",
+						Name:  "spiffe",
+					},
+				},
+				UserAuth: config.UserAuth{
+					ClientCert: &config.ClientCert{
+						SPIFFEID: "spiffe://cluster.local/ns/flux-system/sa/source-controller",
+					},
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return authz
+}
+
+func TestCertificateAuthorization(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://cluster.local/ns/flux-system/sa/source-controller")
+	require.NoError(t, err)
+	otherID, err := url.Parse("spiffe://cluster.local/ns/default/sa/default")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		cert       *x509.Certificate
+		path       string
+		expectedID string
+	}{
+		{
+			name:       "subject match",
+			cert:       &x509.Certificate{Subject: pkix.Name{CommonName: "flux", Organization: []string{"acme"}}},
+			path:       "/org/subject",
+			expectedID: "github.com//subject",
+		},
+		{
+			name: "subject mismatch",
+			cert: &x509.Certificate{Subject: pkix.Name{CommonName: "flux"}},
+			path: "/org/subject",
+		},
+		{
+			name:       "spiffe id match",
+			cert:       &x509.Certificate{URIs: []*url.URL{spiffeID}},
+			path:       "/org/spiffe",
+			expectedID: "github.com//spiffe",
+		},
+		{
+			name: "spiffe id mismatch",
+			cert: &x509.Certificate{URIs: []*url.URL{otherID}},
+			path: "/org/spiffe",
+		},
+		{
+			name: "spiffe id wrong repository",
+			cert: &x509.Certificate{URIs: []*url.URL{spiffeID}},
+			path: "/org/subject",
+		},
+		{
+			name: "no certificate",
+			path: "/org/subject",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authz := getCertificateAuthorizer()
+			e, err := authz.Authorize(context.Background(), Identity{Certificate: tt.cert}, http.MethodGet, tt.path)
+			if tt.expectedID == "" {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedID, e.ID())
+		})
+	}
+}
+
+func TestAuditModeAuthorization(t *testing.T) {
+	// mkpasswd -m sha512crypt incoming-test-token
+	tokenHash := "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou."
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:           "enforce",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Mode:         config.PolicyModeEnforce,
+				Repositories: []*config.Repository{{Owner: "org", Name: "enforced"}},
+				UserAuth:     config.UserAuth{TokenHash: tokenHash},
+			},
+			{
+				ID:           "audit",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Mode:         config.PolicyModeAudit,
+				Repositories: []*config.Repository{{Owner: "org", Name: "audited"}},
+				UserAuth:     config.UserAuth{TokenHash: tokenHash},
+				ReadOnly:     true,
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name        string
+		token       string
+		method      string
+		path        string
+		expectedID  string
+		auditDenied bool
+	}{
+		{
+			name:       "permitted by enforced policy",
+			token:      "incoming-test-token",
+			method:     http.MethodPost,
+			path:       "/org/enforced.git/git-receive-pack",
+			expectedID: "github.com//enforce",
+		},
+		{
+			name:       "permitted by audited policy",
+			token:      "incoming-test-token",
+			method:     http.MethodGet,
+			path:       "/org/audited.git/info/refs",
+			expectedID: "github.com//audit",
+		},
+		{
+			name:        "repository denied by audited policy",
+			token:       "incoming-test-token",
+			method:      http.MethodGet,
+			path:        "/org/other.git/info/refs",
+			expectedID:  "github.com//audit",
+			auditDenied: true,
+		},
+		{
+			name:        "write denied by audited policy",
+			token:       "incoming-test-token",
+			method:      http.MethodPost,
+			path:        "/org/audited.git/git-receive-pack",
+			expectedID:  "github.com//audit",
+			auditDenied: true,
+		},
+		{
+			name:   "invalid token",
+			token:  "invalid-token",
+			method: http.MethodGet,
+			path:   "/org/other.git/info/refs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := authz.Authorize(context.Background(), Identity{Token: tt.token}, tt.method, tt.path)
+			if tt.expectedID == "" {
+				require.ErrorIs(t, err, ErrNotAuthenticated)
+				require.Nil(t, e)
+				return
+			}
+			if tt.auditDenied {
+				require.ErrorIs(t, err, ErrAuditDenied)
+				require.Error(t, authz.IsPermitted(tt.method, tt.path, tt.token))
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expectedID, e.ID())
+		})
+	}
+}
+
+func TestAuditModeAnonymous(t *testing.T) {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:           "anonymous",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Mode:         config.PolicyModeAudit,
+				Repositories: []*config.Repository{{Owner: "org", Name: "public"}},
+				UserAuth:     config.UserAuth{Anonymous: true},
+			},
+		},
+	}
+	_, err := NewAuthorizer(cfg)
+	require.EqualError(t, err, "anonymous policy anonymous cannot use audit mode")
+}
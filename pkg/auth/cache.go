@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	verificationCacheTTL        = 5 * time.Minute
+	verificationCacheMaxEntries = 10000
+
+	cacheResultHit  = "hit"
+	cacheResultMiss = "miss"
+)
+
+var verificationCacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "git_auth_proxy_auth_cache_requests_total",
+	Help: "Total number of token verifications by cache result.",
+}, []string{"result"})
+
+type verification struct {
+	valid   bool
+	expires time.Time
+}
+
+// verificationCache caches the result of checking a token against a token hash, as checking
+// hashes is deliberately expensive and done for every request. Entries are keyed by a keyed
+// hash of the token and token hash so that the tokens are not kept in memory.
+type verificationCache struct {
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	key     []byte
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]verification
+}
+
+func newVerificationCache(ttl time.Duration, maxEntries int) *verificationCache {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &verificationCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+		key:        key,
+		entries:    map[[sha256.Size]byte]verification{},
+	}
+}
+
+// check returns true if the token matches the token hash.
+func (c *verificationCache) check(ctx context.Context, token, tokenHash string) (bool, error) {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(tokenHash))
+	mac.Write([]byte{0})
+	mac.Write([]byte(token))
+	var key [sha256.Size]byte
+	copy(key[:], mac.Sum(nil))
+
+	now := c.now()
+	c.mu.Lock()
+	v, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && now.Before(v.expires) {
+		verificationCacheRequestsTotal.WithLabelValues(cacheResultHit).Inc()
+		return v.valid, nil
+	}
+	verificationCacheRequestsTotal.WithLabelValues(cacheResultMiss).Inc()
+	_, span := tracer.Start(ctx, "CheckTokenHash")
+	valid, err := CheckTokenHash(token, tokenHash)
+	if err != nil {
+		recordError(span, err)
+		span.End()
+		return false, err
+	}
+	span.End()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.entries[key] = verification{valid: valid, expires: now.Add(c.ttl)}
+	return valid, nil
+}
+
+// evict removes the expired entries, and arbitrary entries if the cache is still full.
+func (c *verificationCache) evict(now time.Time) {
+	for k, v := range c.entries {
+		if !now.Before(v.expires) {
+			delete(c.entries, k)
+		}
+	}
+	for k := range c.entries {
+		if len(c.entries) < c.maxEntries {
+			return
+		}
+		delete(c.entries, k)
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerificationCache(t *testing.T) {
+	// mkpasswd -m sha512crypt incoming-test-token
+	hash := "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou."
+	now := time.Now()
+	c := newVerificationCache(time.Minute, 2)
+	c.now = func() time.Time {
+		return now
+	}
+
+	valid, err := c.check(context.Background(), "incoming-test-token", hash)
+	require.NoError(t, err)
+	require.True(t, valid)
+	valid, err = c.check(context.Background(), "invalid-token", hash)
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Len(t, c.entries, 2)
+
+	// Cached results are returned until they expire
+	for _, v := range c.entries {
+		require.Equal(t, now.Add(time.Minute), v.expires)
+	}
+	valid, err = c.check(context.Background(), "incoming-test-token", hash)
+	require.NoError(t, err)
+	require.True(t, valid)
+
+	// Expired entries are evicted before other entries when the cache is full
+	now = now.Add(2 * time.Minute)
+	valid, err = c.check(context.Background(), "other-token", hash)
+	require.NoError(t, err)
+	require.False(t, valid)
+	require.Len(t, c.entries, 1)
+
+	_, err = c.check(context.Background(), "token", "$unsupported$hash")
+	require.Error(t, err)
+}
@@ -1,15 +1,45 @@
 package auth
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
 )
 
+// DownloadPathPrefix is the path prefix under which the download hosts of an upstream are proxied,
+// followed by the download host and the path on it.
+const DownloadPathPrefix = "/_download/"
+
+// downloadURLValidity is how long a signed download path handed out by the proxy can be used.
+const downloadURLValidity = 5 * time.Minute
+
 type Endpoint struct {
-	scheme  string
-	host    string
-	id      string
-	regexes []*regexp.Regexp
+	scheme        string
+	host          string
+	id            string
+	regexes       []*regexp.Regexp
+	regexRules    []string
+	repositories  []*config.Repository
+	listRegex     *regexp.Regexp
+	apiRoutes     []apiRoute
+	downloadHosts []string
+	downloadKey   []byte
+	clientCert    *config.ClientCert
+	anonymous     bool
+	readOnly      bool
+	audit         bool
+	rateLimit     *config.RateLimit
+	upstream      *config.Upstream
 
 	TokenHash string
 }
@@ -18,3 +48,214 @@ func (e *Endpoint) ID() string {
 	comps := []string{e.host, e.id}
 	return strings.Join(comps, "//")
 }
+
+// IsAnonymous returns true if the endpoint applies to requests without credentials.
+func (e *Endpoint) IsAnonymous() bool {
+	return e.anonymous
+}
+
+// PolicyID returns the ID of the policy of the endpoint.
+func (e *Endpoint) PolicyID() string {
+	return e.id
+}
+
+// IsAudit returns true if requests which the endpoint does not permit are proxied anyway.
+func (e *Endpoint) IsAudit() bool {
+	return e.audit
+}
+
+// RateLimit returns the rate limit of the endpoint, nil if it is unlimited.
+func (e *Endpoint) RateLimit() *config.RateLimit {
+	return e.rateLimit
+}
+
+// Upstream returns the upstream connection settings of the endpoint, nil if the defaults are used.
+func (e *Endpoint) Upstream() *config.Upstream {
+	return e.upstream
+}
+
+// explain returns whether the endpoint permits the request, and the rule which permitted or denied it.
+// The rule is empty if the request was denied because no rule matched.
+func (e *Endpoint) explain(method, path string) (string, bool) {
+	if host, downloadPath, ok := splitDownloadPath(path); ok {
+		if !e.permitsDownload(method, host, downloadPath) {
+			return fmt.Sprintf("download from %s", host), false
+		}
+		return fmt.Sprintf("download from %s", host), true
+	}
+	if e.readOnly && !isReadOnly(method, path) {
+		return "read only", false
+	}
+	if path == "/" && len(e.regexes) > 0 {
+		return "root path", true
+	}
+	// Responses of repository lists are filtered to the repositories of the endpoint
+	if e.IsRepositoryList(method, path) {
+		return "repository list, filtered to the repositories of the policy", true
+	}
+	for _, r := range e.apiRoutes {
+		if r.matches(method, path) {
+			return fmt.Sprintf("api route %s", r), true
+		}
+	}
+	for i, r := range e.regexes {
+		if !r.MatchString(path) {
+			continue
+		}
+		if i < len(e.regexRules) {
+			return fmt.Sprintf("%s, pattern %s", e.regexRules[i], r), true
+		}
+		return fmt.Sprintf("pattern %s", r), true
+	}
+	return "", false
+}
+
+// IsRepositoryList returns true if the request lists repositories, the response has
+// to be filtered with PermitsRepository before it is returned to the client.
+func (e *Endpoint) IsRepositoryList(method, path string) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+	return e.listRegex != nil && e.listRegex.MatchString(path)
+}
+
+// ConfiguredRepository returns the repository as it is listed in the endpoint's repositories.
+// It returns false if the repository is not listed or only matches a wildcard.
+func (e *Endpoint) ConfiguredRepository(owner, name string) (string, bool) {
+	for _, r := range e.repositories {
+		if r.Owner == "" || r.Owner == "*" || r.Name == "*" {
+			continue
+		}
+		if strings.EqualFold(r.Owner, owner) && strings.EqualFold(r.Name, name) {
+			return r.Owner + "/" + r.Name, true
+		}
+	}
+	return "", false
+}
+
+// PermitsRepository returns true if the repository is one of the repositories of the endpoint.
+func (e *Endpoint) PermitsRepository(owner, name string) bool {
+	for _, r := range e.repositories {
+		if r.Owner != "" && r.Owner != "*" && !strings.EqualFold(r.Owner, owner) {
+			continue
+		}
+		if r.Name != "*" && !strings.EqualFold(r.Name, name) {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// permitsDownload returns true if the download host of the upstream may be read. Archive paths
+// contain the repository and are checked against the repositories of the endpoint. Other downloads
+// do not identify the repository and are only permitted with a signature of the endpoint, which the
+// proxy adds when it rewrites a URL of the upstream to the download host.
+func (e *Endpoint) permitsDownload(method, host, path string) bool {
+	if method != http.MethodGet && method != http.MethodHead {
+		return false
+	}
+	if !slices.Contains(e.downloadHosts, host) {
+		return false
+	}
+	if !isSignedDownloadHost(host) {
+		return e.matchesPath(path)
+	}
+	signature, path, ok := cutDownloadSignature(path)
+	if !ok {
+		return false
+	}
+	expiry, _, _ := strings.Cut(signature, ".")
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().After(time.Unix(unix, 0)) {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(e.downloadSignature(host, path, unix)))
+}
+
+// signDownloadPath returns the path of the download host prefixed with a signature of the endpoint.
+func (e *Endpoint) signDownloadPath(host, path string) string {
+	return "/" + e.downloadSignature(host, path, time.Now().Add(downloadURLValidity).Unix()) + path
+}
+
+// downloadSignature returns the signature of the path of the download host, which expires at the given time.
+func (e *Endpoint) downloadSignature(host, path string, expiry int64) string {
+	mac := hmac.New(sha256.New, e.downloadKey)
+	mac.Write([]byte(strings.Join([]string{e.ID(), host, path, strconv.FormatInt(expiry, 10)}, "\n")))
+	return strconv.FormatInt(expiry, 10) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (e *Endpoint) matchesPath(path string) bool {
+	for _, r := range e.regexes {
+		if r.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitDownloadPath returns the download host and the path on it if the path is below DownloadPathPrefix.
+func splitDownloadPath(path string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(path, DownloadPathPrefix)
+	if !ok {
+		return "", "", false
+	}
+	host, downloadPath, _ := strings.Cut(rest, "/")
+	if host == "" {
+		return "", "", false
+	}
+	return host, "/" + downloadPath, true
+}
+
+// isSignedDownloadHost returns true if paths of the download host have to be signed by the proxy.
+func isSignedDownloadHost(host string) bool {
+	return !strings.HasPrefix(host, "codeload.")
+}
+
+// cutDownloadSignature returns the signature of a signed download path and the path on the download host.
+func cutDownloadSignature(path string) (string, string, bool) {
+	signature, rest, ok := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if !ok || signature == "" {
+		return "", "", false
+	}
+	return signature, "/" + rest, true
+}
+
+// isReadOnly returns true if the request cannot modify a repository. Fetches and clones are
+// sent as POST requests to git-upload-pack, all other requests have to use a safe method.
+func isReadOnly(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		return strings.HasSuffix(path, "/git-upload-pack")
+	default:
+		return false
+	}
+}
+
+// MatchesCertificate returns true if the certificate satisfies all attributes set in the endpoint's client certificate selector.
+func (e *Endpoint) MatchesCertificate(cert *x509.Certificate) bool {
+	if e.clientCert == nil || cert == nil {
+		return false
+	}
+	if e.clientCert.Subject != "" && e.clientCert.Subject != cert.Subject.String() {
+		return false
+	}
+	if e.clientCert.URI != "" && !hasURI(cert, e.clientCert.URI) {
+		return false
+	}
+	if e.clientCert.SPIFFEID != "" && !hasURI(cert, e.clientCert.SPIFFEID) {
+		return false
+	}
+	return true
+}
+
+func hasURI(cert *x509.Certificate, uri string) bool {
+	for _, u := range cert.URIs {
+		if u.String() == uri {
+			return true
+		}
+	}
+	return false
+}
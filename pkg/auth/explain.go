@@ -0,0 +1,70 @@
+package auth
+
+// Decision is the outcome of evaluating a request against a single endpoint.
+type Decision struct {
+	Endpoint  *Endpoint
+	Permitted bool
+	// Rule is the rule of the endpoint which permitted or denied the request, empty if no rule matched.
+	Rule string
+}
+
+// Explanation describes how a request is authorized.
+type Explanation struct {
+	// Decisions of all endpoints in the order in which they are evaluated.
+	Decisions []Decision
+	// Endpoint is the endpoint which authorizes the request, nil if the request is denied.
+	Endpoint *Endpoint
+	// Audit is true if the request is only proxied because Endpoint is in audit mode.
+	Audit bool
+}
+
+// Explain evaluates the request against the endpoints in the same way as Authorize, but does not
+// stop at the first endpoint which permits the request.
+func Explain(endpoints []*Endpoint, method, path string) *Explanation {
+	explanation := &Explanation{}
+	explanation.Endpoint, explanation.Audit = evaluate(endpoints, method, path, func(d Decision) {
+		explanation.Decisions = append(explanation.Decisions, d)
+	})
+	return explanation
+}
+
+// evaluate returns the endpoint which authorizes the request, and whether the request is only authorized
+// because the endpoint is in audit mode. The first endpoint permitting the request authorizes it, otherwise
+// the first endpoint in audit mode. Evaluation stops at the first permitting endpoint unless the decisions
+// of all endpoints are reported to decide.
+func evaluate(endpoints []*Endpoint, method, path string, decide func(Decision)) (*Endpoint, bool) {
+	var permitted *Endpoint
+	for _, e := range endpoints {
+		rule, ok := e.explain(method, path)
+		if decide == nil {
+			if ok {
+				return e, false
+			}
+			continue
+		}
+		decide(Decision{Endpoint: e, Permitted: ok, Rule: rule})
+		if ok && permitted == nil {
+			permitted = e
+		}
+	}
+	if permitted != nil {
+		return permitted, false
+	}
+	for _, e := range endpoints {
+		if e.IsAudit() {
+			return e, true
+		}
+	}
+	return nil, false
+}
+
+// GetEndpointsByPolicyID returns the endpoints of all policies with the ID, regardless of their host.
+func (a *Authorizer) GetEndpointsByPolicyID(id string) []*Endpoint {
+	endpoints := []*Endpoint{}
+	for _, e := range a.endpoints {
+		if e.id == id {
+			endpoints = append(endpoints, e)
+		}
+	}
+	return endpoints
+}
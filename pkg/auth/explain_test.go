@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestExplain(t *testing.T) {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:           "dev",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+				APIRoutes:    []string{"GET /orgs/org/teams"},
+				UserAuth:     config.UserAuth{ClientCert: &config.ClientCert{Subject: "CN=dev"}},
+			},
+			{
+				ID:           "audit",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Mode:         config.PolicyModeAudit,
+				Repositories: []*config.Repository{{Owner: "acme", Name: "*"}},
+				UserAuth:     config.UserAuth{ClientCert: &config.ClientCert{Subject: "CN=audit"}},
+				ReadOnly:     true,
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+	endpoints := authz.GetEndpoints()
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		rules      []string
+		permitted  []bool
+		expectedID string
+		audit      bool
+	}{
+		{
+			name:       "repository",
+			method:     http.MethodGet,
+			path:       "/org/repo.git/info/refs",
+			rules:      []string{`repository org/repo, pattern (?i)/org/repo(/.*)?\b`, ""},
+			permitted:  []bool{true, false},
+			expectedID: "github.com//dev",
+		},
+		{
+			name:       "api route",
+			method:     http.MethodGet,
+			path:       "/api/v3/orgs/org/teams",
+			rules:      []string{"api route GET /api/v3/orgs/org/teams", ""},
+			permitted:  []bool{true, false},
+			expectedID: "github.com//dev",
+		},
+		{
+			name:       "audit",
+			method:     http.MethodPost,
+			path:       "/org/other.git/git-receive-pack",
+			rules:      []string{"", "read only"},
+			permitted:  []bool{false, false},
+			expectedID: "github.com//audit",
+			audit:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			explanation := Explain(endpoints, tt.method, tt.path)
+			require.Len(t, explanation.Decisions, len(endpoints))
+			for i, d := range explanation.Decisions {
+				require.Equal(t, endpoints[i], d.Endpoint)
+				require.Equal(t, tt.rules[i], d.Rule)
+				require.Equal(t, tt.permitted[i], d.Permitted)
+			}
+			require.Equal(t, tt.expectedID, explanation.Endpoint.ID())
+			require.Equal(t, tt.audit, explanation.Audit)
+
+			// Authorize stops at the first permitting endpoint but has to select the same endpoint
+			e, audit := evaluate(endpoints, tt.method, tt.path, nil)
+			require.Same(t, explanation.Endpoint, e)
+			require.Equal(t, tt.audit, audit)
+		})
+	}
+
+	require.Equal(t, []*Endpoint{endpoints[1]}, authz.GetEndpointsByPolicyID("audit"))
+	require.Empty(t, authz.GetEndpointsByPolicyID("missing"))
+}
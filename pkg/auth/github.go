@@ -4,12 +4,17 @@ import (
 	"context"
 	b64 "encoding/base64"
 	"fmt"
+	"net/url"
 	"regexp"
+	"slices"
 	"strings"
 )
 
 const standardGitHub = "github.com"
 
+// githubRepositoryList matches the API routes which list repositories.
+var githubRepositoryList = regexp.MustCompile(`(?i)^/api/v3/(user/repos|(orgs|users)/[^/]+/repos|installation/repositories|user/installations/[^/]+/repositories)/?$`)
+
 type GitHubTokenSource interface {
 	Token(ctx context.Context) (string, error)
 }
@@ -26,10 +31,7 @@ func (s githubDummyTokenSource) Token(_ctx context.Context) (string, error) {
 	return s.token, nil
 }
 
-func newGithub(token string) *github {
-	itr := githubDummyTokenSource{
-		token: token,
-	}
+func newGithub(itr GitHubTokenSource) *github {
 	return &github{itr: itr}
 }
 
@@ -63,6 +65,9 @@ func (g *github) getPathRegex(owner, repository string) ([]*regexp.Regexp, error
 }
 
 func (g *github) getAuthorizationHeader(ctx context.Context, path string) (string, error) {
+	if u := upstreamRequestFromContext(ctx); u != nil && strings.HasPrefix(path, "/graphql") {
+		u.resource = rateLimitResourceGraphQL
+	}
 	token, err := g.itr.Token(ctx)
 	if err != nil {
 		return "", fmt.Errorf("error when fetching GitHub token: %w", err)
@@ -98,3 +103,36 @@ func (g *github) getPath(e *Endpoint, path string) string {
 	newPath := strings.TrimPrefix(path, "/api/v3")
 	return newPath
 }
+
+func (g *github) getRepositoryListRegex() *regexp.Regexp {
+	return githubRepositoryList
+}
+
+// getDownloadHosts returns the hosts archives and release assets are redirected to.
+func (g *github) getDownloadHosts(host string) []string {
+	if host != standardGitHub {
+		return []string{fmt.Sprintf("codeload.%s", host), fmt.Sprintf("media.%s", host)}
+	}
+	return []string{"codeload.github.com", "objects.githubusercontent.com", "release-assets.githubusercontent.com"}
+}
+
+func (g *github) getProxyPath(e *Endpoint, u *url.URL) (string, bool) {
+	path := u.EscapedPath()
+	switch {
+	case strings.EqualFold(u.Host, e.host):
+	case e.host == standardGitHub && strings.EqualFold(u.Host, fmt.Sprintf("api.%s", e.host)):
+		path = "/api/v3" + path
+	case slices.Contains(e.downloadHosts, strings.ToLower(u.Host)):
+		host := strings.ToLower(u.Host)
+		if isSignedDownloadHost(host) {
+			path = e.signDownloadPath(host, path)
+		}
+		path = DownloadPathPrefix + host + path
+	default:
+		return "", false
+	}
+	if u.RawQuery != "" {
+		path = path + "?" + u.RawQuery
+	}
+	return path, true
+}
@@ -3,7 +3,11 @@ package auth
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/legobeat/git-auth-proxy/pkg/config"
 	"github.com/stretchr/testify/require"
@@ -96,7 +100,7 @@ func getGitHubAuthorizerMixed() *Authorizer {
 					},
 				},
 				UserAuth: config.UserAuth{
-					TokenHash: "",
+					Anonymous: true,
 				},
 			},
 		},
@@ -167,7 +171,7 @@ func TestGitHubMixedAuthorization(t *testing.T) {
 			endpoint, err := authz.GetEndpointById("github.com//private")
 			require.NotNil(t, endpoint)
 			require.NoError(t, err)
-			err = authz.IsPermitted(tt.path, "private-test-token")
+			err = authz.IsPermitted(http.MethodGet, tt.path, "private-test-token")
 
 			if tt.allow {
 				require.NoError(t, err)
@@ -237,7 +241,7 @@ func TestGitHubAuthorization(t *testing.T) {
 			endpoint, err := authz.GetEndpointById("github.com//123")
 			require.NotNil(t, endpoint)
 			require.NoError(t, err)
-			err = authz.IsPermitted(tt.path, "incoming-test-token")
+			err = authz.IsPermitted(http.MethodGet, tt.path, "incoming-test-token")
 
 			if tt.allow {
 				require.NoError(t, err)
@@ -369,9 +373,9 @@ func TestGetEndpointByToken(t *testing.T) {
 			expectedId: "github.com//private",
 		},
 		{
-			name:       "invalid token: public endpoints",
+			name:       "invalid token: no endpoints",
 			token:      "invalid-token",
-			expectedId: "github.com//public",
+			expectedId: "",
 		},
 		{
 			name:       "no token: public endpoints",
@@ -383,9 +387,261 @@ func TestGetEndpointByToken(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			authz := getGitHubAuthorizerMixed()
 			endpoint, err := authz.GetEndpointByToken(tt.token)
+			if tt.expectedId == "" {
+				require.Error(t, err)
+				return
+			}
 			require.NotNil(t, endpoint)
 			require.NoError(t, err)
 			require.Equal(t, tt.expectedId, endpoint.ID())
 		})
 	}
 }
+
+func TestGitHubAnonymousAuthorization(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		allow  bool
+	}{
+		{
+			name:   "allow anonymous clone",
+			method: http.MethodGet,
+			path:   "/foo/bar/info/refs",
+			allow:  true,
+		},
+		{
+			name:   "allow anonymous fetch",
+			method: http.MethodPost,
+			path:   "/foo/bar/git-upload-pack",
+			allow:  true,
+		},
+		{
+			name:   "disallow anonymous push",
+			method: http.MethodPost,
+			path:   "/foo/bar/git-receive-pack",
+			allow:  false,
+		},
+		{
+			name:   "disallow anonymous api write",
+			method: http.MethodPatch,
+			path:   "/api/v3/repos/foo/bar",
+			allow:  false,
+		},
+		{
+			name:   "disallow invalid token",
+			method: http.MethodGet,
+			path:   "/foo/bar/info/refs",
+			token:  "invalid-token",
+			allow:  false,
+		},
+		{
+			name:   "allow valid token push",
+			method: http.MethodPost,
+			path:   "/org/repo/git-receive-pack",
+			token:  "private-test-token",
+			allow:  true,
+		},
+		{
+			name:   "allow valid token anonymous clone",
+			method: http.MethodGet,
+			path:   "/foo/bar/info/refs",
+			token:  "private-test-token",
+			allow:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authz := getGitHubAuthorizerMixed()
+			err := authz.IsPermitted(tt.method, tt.path, tt.token)
+			if tt.allow {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestGetProxyPath(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		url      string
+		expected string
+		ok       bool
+	}{
+		{
+			name:     "git standard github",
+			host:     standardGitHub,
+			url:      "https://github.com/org/repo.git/info/refs?service=git-upload-pack",
+			expected: "/org/repo.git/info/refs?service=git-upload-pack",
+			ok:       true,
+		},
+		{
+			name:     "api standard github",
+			host:     standardGitHub,
+			url:      "https://api.github.com/repos/org/repo?page=2",
+			expected: "/api/v3/repos/org/repo?page=2",
+			ok:       true,
+		},
+		{
+			name:     "api enterprise github",
+			host:     "example.com",
+			url:      "https://example.com/api/v3/repos/org/repo",
+			expected: "/api/v3/repos/org/repo",
+			ok:       true,
+		},
+		{
+			name:     "codeload standard github",
+			host:     standardGitHub,
+			url:      "https://codeload.github.com/org/repo/legacy.tar.gz/refs/heads/main?token=abc",
+			expected: "/_download/codeload.github.com/org/repo/legacy.tar.gz/refs/heads/main?token=abc",
+			ok:       true,
+		},
+		{
+			name: "other host",
+			host: standardGitHub,
+			url:  "https://example.com/org/repo",
+			ok:   false,
+		},
+	}
+	gh := &github{itr: &MockGitHubTokenSource{}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &Endpoint{
+				host:          tt.host,
+				downloadHosts: gh.getDownloadHosts(tt.host),
+			}
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			path, ok := gh.getProxyPath(e, u)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.expected, path)
+		})
+	}
+}
+
+func TestGitHubDownloadAuthorization(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		allow  bool
+	}{
+		{
+			name:   "allow permitted repository archive",
+			method: http.MethodGet,
+			path:   "/_download/codeload.github.com/org/repo/legacy.tar.gz/refs/heads/main",
+			allow:  true,
+		},
+		{
+			name:   "disallow other repository archive",
+			method: http.MethodGet,
+			path:   "/_download/codeload.github.com/org/other/legacy.tar.gz/refs/heads/main",
+			allow:  false,
+		},
+		{
+			name:   "disallow unsigned release asset",
+			method: http.MethodGet,
+			path:   "/_download/objects.githubusercontent.com/github-production-release-asset/1/2",
+			allow:  false,
+		},
+		{
+			name:   "disallow unknown host",
+			method: http.MethodGet,
+			path:   "/_download/example.com/org/repo",
+			allow:  false,
+		},
+		{
+			name:   "disallow write",
+			method: http.MethodPost,
+			path:   "/_download/codeload.github.com/org/repo/legacy.tar.gz/refs/heads/main",
+			allow:  false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authz := getGitHubAuthorizerSingle()
+			err := authz.IsPermitted(tt.method, tt.path, "incoming-test-token")
+			if tt.allow {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestUpdateRequestDownload(t *testing.T) {
+	authz := getGitHubAuthorizerSingle()
+	e, err := authz.GetEndpointByToken("incoming-test-token")
+	require.NoError(t, err)
+	e.scheme = "https"
+	req, err := http.NewRequest(http.MethodGet, "/_download/codeload.github.com/org/repo/legacy.tar.gz/refs/heads/main", nil)
+	require.NoError(t, err)
+	req, target, err := authz.UpdateRequest(context.Background(), req, e)
+	require.NoError(t, err)
+	require.Equal(t, "codeload.github.com", req.Host)
+	require.Equal(t, "codeload.github.com", target.Host)
+	require.Equal(t, "/org/repo/legacy.tar.gz/refs/heads/main", req.URL.Path)
+	require.Empty(t, req.Header.Get("Authorization"))
+}
+
+func TestGitHubSignedDownload(t *testing.T) {
+	authz := getGitHubAuthorizerMixed()
+	private, err := authz.GetEndpointById("github.com//private")
+	require.NoError(t, err)
+	public, err := authz.GetEndpointById("github.com//public")
+	require.NoError(t, err)
+	u, err := url.Parse("https://objects.githubusercontent.com/github-production-release-asset/1/2?X-Amz-Signature=abc")
+	require.NoError(t, err)
+	path, ok := authz.ProxyPath(private, u)
+	require.True(t, ok)
+	path, query, _ := strings.Cut(path, "?")
+	require.Equal(t, "X-Amz-Signature=abc", query)
+
+	// Only the endpoint which rewrote the URL may download it
+	_, permitted := private.explain(http.MethodGet, path)
+	require.True(t, permitted)
+	_, permitted = public.explain(http.MethodGet, path)
+	require.False(t, permitted)
+	_, permitted = private.explain(http.MethodGet, strings.Replace(path, "/1/2", "/1/3", 1))
+	require.False(t, permitted)
+	_, permitted = private.explain(http.MethodGet, path+"/other")
+	require.False(t, permitted)
+
+	expired := DownloadPathPrefix + "objects.githubusercontent.com" +
+		"/" + private.downloadSignature("objects.githubusercontent.com", "/github-production-release-asset/1/2", time.Now().Add(-time.Minute).Unix()) +
+		"/github-production-release-asset/1/2"
+	_, permitted = private.explain(http.MethodGet, expired)
+	require.False(t, permitted)
+
+	private.scheme = "https"
+	req, err := http.NewRequest(http.MethodGet, path, nil)
+	require.NoError(t, err)
+	req, target, err := authz.UpdateRequest(context.Background(), req, private)
+	require.NoError(t, err)
+	require.Equal(t, "objects.githubusercontent.com", target.Host)
+	require.Equal(t, "/github-production-release-asset/1/2", req.URL.Path)
+}
+
+func TestGitHubRepositoryList(t *testing.T) {
+	authz := getGitHubAuthorizerSingle()
+	e, err := authz.GetEndpointByToken("incoming-test-token")
+	require.NoError(t, err)
+
+	require.True(t, e.IsRepositoryList(http.MethodGet, "/api/v3/user/repos"))
+	require.True(t, e.IsRepositoryList(http.MethodGet, "/api/v3/orgs/acme/repos"))
+	require.True(t, e.IsRepositoryList(http.MethodGet, "/api/v3/installation/repositories"))
+	require.False(t, e.IsRepositoryList(http.MethodPost, "/api/v3/user/repos"))
+	require.False(t, e.IsRepositoryList(http.MethodGet, "/api/v3/repos/org/repo"))
+	require.NoError(t, authz.IsPermitted(http.MethodGet, "/api/v3/user/repos", "incoming-test-token"))
+
+	require.True(t, e.PermitsRepository("org", "repo"))
+	require.True(t, e.PermitsRepository("ORG", "FooBar"))
+	require.False(t, e.PermitsRepository("org", "other"))
+	require.False(t, e.PermitsRepository("other", "repo"))
+}
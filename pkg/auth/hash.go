@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/go-crypt/crypt"
+	"github.com/go-crypt/crypt/algorithm"
+	"github.com/go-crypt/crypt/algorithm/argon2"
+	"github.com/go-crypt/crypt/algorithm/bcrypt"
+	"github.com/go-crypt/crypt/algorithm/shacrypt"
+)
+
+const (
+	HashAlgorithmArgon2id    = "argon2id"
+	HashAlgorithmBcrypt      = "bcrypt"
+	HashAlgorithmSHA512Crypt = "sha512crypt"
+
+	// tokenLength is the number of random bytes of a generated token.
+	tokenLength = 32
+)
+
+// HashAlgorithms are the algorithms client tokens can be hashed with.
+var HashAlgorithms = []string{HashAlgorithmArgon2id, HashAlgorithmBcrypt, HashAlgorithmSHA512Crypt}
+
+// NewToken returns a random client token.
+func NewToken() (string, error) {
+	b := make([]byte, tokenLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken hashes the token with the algorithm for use as the token hash of a policy. Generated tokens
+// have too much entropy to be guessed, so the cheapest recommended parameters are used to keep
+// checking tokens fast for requests which miss the verification cache.
+func HashToken(token, alg string) (string, error) {
+	var hasher algorithm.Hash
+	var err error
+	switch alg {
+	case HashAlgorithmArgon2id:
+		hasher, err = argon2.New(argon2.WithVariantID(), argon2.WithM(19456), argon2.WithT(2), argon2.WithP(1), argon2.WithK(32), argon2.WithS(16))
+	case HashAlgorithmBcrypt:
+		hasher, err = bcrypt.New(bcrypt.WithCost(10))
+	case HashAlgorithmSHA512Crypt:
+		hasher, err = shacrypt.New(shacrypt.WithSHA512(), shacrypt.WithRounds(5000))
+	default:
+		return "", fmt.Errorf("unsupported hash algorithm %s", alg)
+	}
+	if err != nil {
+		return "", err
+	}
+	digest, err := hasher.Hash(token)
+	if err != nil {
+		return "", err
+	}
+	return digest.Encode(), nil
+}
+
+// CheckTokenHash returns true if the token matches the token hash.
+func CheckTokenHash(token, tokenHash string) (bool, error) {
+	return crypt.CheckPassword(token, tokenHash)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashToken(t *testing.T) {
+	token, err := NewToken()
+	require.NoError(t, err)
+	require.Len(t, token, 43)
+	other, err := NewToken()
+	require.NoError(t, err)
+	require.NotEqual(t, token, other)
+
+	prefixes := map[string]string{
+		HashAlgorithmArgon2id:    "$argon2id$",
+		HashAlgorithmBcrypt:      "$2b$",
+		HashAlgorithmSHA512Crypt: "$6$",
+	}
+	for _, alg := range HashAlgorithms {
+		t.Run(alg, func(t *testing.T) {
+			hash, err := HashToken(token, alg)
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(hash, prefixes[alg]), hash)
+			valid, err := CheckTokenHash(token, hash)
+			require.NoError(t, err)
+			require.True(t, valid)
+			valid, err = CheckTokenHash(other, hash)
+			require.NoError(t, err)
+			require.False(t, valid)
+		})
+	}
+
+	_, err = HashToken(token, "md5crypt")
+	require.EqualError(t, err, "unsupported hash algorithm md5crypt")
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const apiPathPrefix = "/api/v3"
+
+// apiRoute is an API route permitted in addition to the repository routes of a policy. Routes are
+// written as a method followed by a path, for example "GET /orgs/acme/teams". A "*" method matches
+// any method, a "*" segment matches a single path segment and a trailing "**" segment matches the
+// remainder of the path.
+type apiRoute struct {
+	method   string
+	segments []string
+}
+
+func parseAPIRoute(s string) (apiRoute, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return apiRoute{}, fmt.Errorf("invalid api route %q: expected method and path", s)
+	}
+	method := strings.ToUpper(fields[0])
+	switch method {
+	case "*", http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		return apiRoute{}, fmt.Errorf("invalid api route %q: unsupported method %s", s, fields[0])
+	}
+	path := strings.TrimPrefix(fields[1], apiPathPrefix)
+	if !strings.HasPrefix(path, "/") || path == "/" {
+		return apiRoute{}, fmt.Errorf("invalid api route %q: path has to be absolute", s)
+	}
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, segment := range segments {
+		if segment == "" {
+			return apiRoute{}, fmt.Errorf("invalid api route %q: empty path segment", s)
+		}
+		if segment == "**" && i != len(segments)-1 {
+			return apiRoute{}, fmt.Errorf("invalid api route %q: ** is only allowed as the last segment", s)
+		}
+	}
+	return apiRoute{method: method, segments: segments}, nil
+}
+
+func (r apiRoute) String() string {
+	return r.method + " " + apiPathPrefix + "/" + strings.Join(r.segments, "/")
+}
+
+// matches returns true if the request matches the route. The path has to be an API path with the /api/v3 prefix.
+func (r apiRoute) matches(method, path string) bool {
+	if r.method != "*" && r.method != method {
+		return false
+	}
+	path, ok := strings.CutPrefix(path, apiPathPrefix+"/")
+	if !ok {
+		return false
+	}
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for _, segment := range segments {
+		if !isPlainSegment(segment) {
+			return false
+		}
+	}
+	for i, segment := range r.segments {
+		if segment == "**" {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if segment != "*" && !strings.EqualFold(segment, segments[i]) {
+			return false
+		}
+	}
+	return len(segments) == len(r.segments)
+}
+
+// isPlainSegment returns false for escaped path segments which could be resolved to another path by
+// the upstream, such as dot segments and segments containing encoded slashes, so that wildcards
+// cannot be used to escape the route.
+func isPlainSegment(segment string) bool {
+	unescaped, err := url.PathUnescape(segment)
+	if err != nil {
+		return false
+	}
+	if unescaped == "" || unescaped == "." || unescaped == ".." {
+		return false
+	}
+	return !strings.ContainsAny(unescaped, "/\\")
+}
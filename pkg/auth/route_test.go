@@ -0,0 +1,176 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestParseAPIRoute(t *testing.T) {
+	tests := []struct {
+		route string
+		valid bool
+	}{
+		{route: "GET /orgs/acme/teams", valid: true},
+		{route: "get /api/v3/rate_limit", valid: true},
+		{route: "* /orgs/*/teams/**", valid: true},
+		{route: "/orgs/acme/teams", valid: false},
+		{route: "FETCH /orgs/acme/teams", valid: false},
+		{route: "GET orgs/acme/teams", valid: false},
+		{route: "GET /orgs//teams", valid: false},
+		{route: "GET /orgs/**/teams", valid: false},
+		{route: "GET /", valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			_, err := parseAPIRoute(tt.route)
+			if tt.valid {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestAPIRouteAuthorization(t *testing.T) {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:       "automation",
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Repositories: []*config.Repository{
+					{
+						Owner: "acme",
+						Name:  "repo",
+					},
+				},
+				APIRoutes: []string{
+					"GET /orgs/acme/teams",
+					"GET /rate_limit",
+					"POST /orgs/acme/actions/runners/registration-token",
+					"* /orgs/acme/hooks/*",
+					"GET /orgs/acme/members/**",
+				},
+				UserAuth: config.UserAuth{
+					// mkpasswd -m sha512crypt incoming-test-token
+					TokenHash: "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou.",
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		allow  bool
+	}{
+		{
+			name:   "allow listed route",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/acme/teams",
+			allow:  true,
+		},
+		{
+			name:   "allow listed route with different case",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/ACME/teams",
+			allow:  true,
+		},
+		{
+			name:   "allow listed post route",
+			method: http.MethodPost,
+			path:   "/api/v3/orgs/acme/actions/runners/registration-token",
+			allow:  true,
+		},
+		{
+			name:   "disallow other method",
+			method: http.MethodPost,
+			path:   "/api/v3/orgs/acme/teams",
+			allow:  false,
+		},
+		{
+			name:   "disallow other org",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/other/teams",
+			allow:  false,
+		},
+		{
+			name:   "disallow route without api prefix",
+			method: http.MethodGet,
+			path:   "/rate_limit",
+			allow:  false,
+		},
+		{
+			name:   "allow segment wildcard",
+			method: http.MethodDelete,
+			path:   "/api/v3/orgs/acme/hooks/123",
+			allow:  true,
+		},
+		{
+			name:   "disallow segment wildcard for more segments",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/acme/hooks/123/pings",
+			allow:  false,
+		},
+		{
+			name:   "allow remainder wildcard",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/acme/members/octocat/roles",
+			allow:  true,
+		},
+		{
+			name:   "disallow dot segments after remainder wildcard",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/acme/members/../../../user/repos",
+			allow:  false,
+		},
+		{
+			name:   "disallow escaped dot segments after remainder wildcard",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/acme/members/%2e%2e/%2E%2E/%2e%2e/user/repos",
+			allow:  false,
+		},
+		{
+			name:   "disallow dot segment as segment wildcard",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/acme/hooks/..",
+			allow:  false,
+		},
+		{
+			name:   "disallow encoded slash in segment wildcard",
+			method: http.MethodDelete,
+			path:   "/api/v3/orgs/acme/hooks/..%2F..%2F..%2Fuser",
+			allow:  false,
+		},
+		{
+			name:   "disallow empty segments",
+			method: http.MethodGet,
+			path:   "/api/v3/orgs/acme/members//octocat",
+			allow:  false,
+		},
+		{
+			name:   "allow repository route",
+			method: http.MethodGet,
+			path:   "/api/v3/repos/acme/repo/",
+			allow:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authz.IsPermitted(tt.method, tt.path, "incoming-test-token")
+			if tt.allow {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
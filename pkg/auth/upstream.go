@@ -0,0 +1,200 @@
+package auth
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	rateLimitResourceCore    = "core"
+	rateLimitResourceGraphQL = "graphql"
+)
+
+var (
+	upstreamRateLimitLimit = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_auth_proxy_upstream_rate_limit_limit",
+		Help: "Request limit of the upstream credential as reported by the upstream.",
+	}, []string{"credential", "resource"})
+	upstreamRateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_auth_proxy_upstream_rate_limit_remaining",
+		Help: "Remaining requests of the upstream credential as reported by the upstream.",
+	}, []string{"credential", "resource"})
+	upstreamRateLimitReset = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_auth_proxy_upstream_rate_limit_reset_timestamp_seconds",
+		Help: "Time at which the rate limit of the upstream credential resets, in seconds since the epoch.",
+	}, []string{"credential", "resource"})
+	tokenSourceErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_token_source_errors_total",
+		Help: "Total number of errors fetching an upstream token by policy.",
+	}, []string{"policy"})
+)
+
+type upstreamContextKey struct{}
+
+// upstreamRequest records which upstream credential was used for a request, so that the
+// rate limit in the response can be attributed to it.
+type upstreamRequest struct {
+	resource   string
+	credential *upstreamCredential
+}
+
+func withUpstreamRequest(ctx context.Context) (context.Context, *upstreamRequest) {
+	u := &upstreamRequest{resource: rateLimitResourceCore}
+	return context.WithValue(ctx, upstreamContextKey{}, u), u
+}
+
+func upstreamRequestFromContext(ctx context.Context) *upstreamRequest {
+	u, ok := ctx.Value(upstreamContextKey{}).(*upstreamRequest)
+	if !ok {
+		return nil
+	}
+	return u
+}
+
+// UpstreamCredentialLabel returns the label of the upstream credential used for the request
+// which was updated with the context, empty if no credential has been selected.
+func UpstreamCredentialLabel(ctx context.Context) string {
+	u := upstreamRequestFromContext(ctx)
+	if u == nil || u.credential == nil {
+		return ""
+	}
+	return u.credential.label
+}
+
+// rateBudget is the rate limit state of a single upstream rate limit resource.
+type rateBudget struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// upstreamCredential is a single upstream token source and its last observed rate limits.
+type upstreamCredential struct {
+	label  string
+	source GitHubTokenSource
+
+	mu      sync.Mutex
+	budgets map[string]rateBudget
+}
+
+func newUpstreamCredential(label string, source GitHubTokenSource) *upstreamCredential {
+	return &upstreamCredential{
+		label:   label,
+		source:  source,
+		budgets: map[string]rateBudget{},
+	}
+}
+
+// remaining returns the remaining budget of the resource. A budget which has never been
+// observed, or whose reset time has passed, is assumed to be unused.
+func (c *upstreamCredential) remaining(resource string, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.budgets[resource]
+	if !ok || now.After(b.reset) {
+		return math.MaxInt
+	}
+	return b.remaining
+}
+
+func (c *upstreamCredential) observe(resource string, b rateBudget) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.budgets[resource] = b
+	upstreamRateLimitLimit.WithLabelValues(c.label, resource).Set(float64(b.limit))
+	upstreamRateLimitRemaining.WithLabelValues(c.label, resource).Set(float64(b.remaining))
+	upstreamRateLimitReset.WithLabelValues(c.label, resource).Set(float64(b.reset.Unix()))
+}
+
+// tokenPool is a token source which picks the credential with the most remaining rate limit budget.
+type tokenPool struct {
+	credentials []*upstreamCredential
+	now         func() time.Time
+}
+
+func newTokenPool(credentials []*upstreamCredential) *tokenPool {
+	return &tokenPool{
+		credentials: credentials,
+		now:         time.Now,
+	}
+}
+
+func (p *tokenPool) Token(ctx context.Context) (string, error) {
+	u := upstreamRequestFromContext(ctx)
+	resource := rateLimitResourceCore
+	if u != nil {
+		resource = u.resource
+	}
+	now := p.now()
+	var best *upstreamCredential
+	bestRemaining := -1
+	for _, c := range p.credentials {
+		if remaining := c.remaining(resource, now); remaining > bestRemaining {
+			best = c
+			bestRemaining = remaining
+		}
+	}
+	if best == nil {
+		return "", nil
+	}
+	if u != nil {
+		u.credential = best
+	}
+	ctx, span := tracer.Start(ctx, "Token", trace.WithAttributes(attribute.String("credential", best.label)))
+	defer span.End()
+	token, err := best.source.Token(ctx)
+	if err != nil {
+		recordError(span, err)
+	}
+	return token, err
+}
+
+// ObserveResponse records the upstream rate limit headers of the response for the credential used by the request.
+func (a *Authorizer) ObserveResponse(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	u := upstreamRequestFromContext(resp.Request.Context())
+	if u == nil || u.credential == nil {
+		return
+	}
+	b, resource, ok := parseRateLimit(resp.Header)
+	if !ok {
+		return
+	}
+	if resource == "" {
+		resource = u.resource
+	}
+	u.credential.observe(resource, b)
+}
+
+// parseRateLimit parses the GitHub rate limit headers.
+func parseRateLimit(header http.Header) (rateBudget, string, bool) {
+	limit, err := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		return rateBudget{}, "", false
+	}
+	remaining, err := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return rateBudget{}, "", false
+	}
+	reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return rateBudget{}, "", false
+	}
+	b := rateBudget{
+		limit:     limit,
+		remaining: remaining,
+		reset:     time.Unix(reset, 0),
+	}
+	return b, header.Get("X-RateLimit-Resource"), true
+}
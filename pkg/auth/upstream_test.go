@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func getGitHubAuthorizerPool() *Authorizer {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:       "pool",
+				Provider: config.GitHubProviderType,
+				GitHub: config.GitHub{
+					Tokens: []string{"first", "second"},
+				},
+				Host:   "github.com",
+				Scheme: "https",
+				Repositories: []*config.Repository{
+					{
+						Owner: "org",
+						Name:  "repo",
+					},
+				},
+				UserAuth: config.UserAuth{
+					Anonymous: true,
+				},
+			},
+		},
+	}
+	authz, err := NewAuthorizer(cfg)
+	if err != nil {
+		panic(err)
+	}
+	return authz
+}
+
+// roundTrip updates a request with the authorizer and returns the upstream token used for it.
+func roundTrip(t *testing.T, authz *Authorizer, path string, remaining int) string {
+	t.Helper()
+
+	e, err := authz.GetEndpointById("github.com//pool")
+	require.NoError(t, err)
+	req, err := http.NewRequestWithContext(context.TODO(), http.MethodGet, "http://proxy"+path, nil)
+	require.NoError(t, err)
+	req, _, err = authz.UpdateRequest(req.Context(), req, e)
+	require.NoError(t, err)
+
+	resp := &http.Response{Request: req, Header: http.Header{}}
+	resp.Header.Set("X-RateLimit-Limit", "5000")
+	resp.Header.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	resp.Header.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+	authz.ObserveResponse(resp)
+
+	token := req.Header.Get("Authorization")
+	require.NotEmpty(t, token)
+	return token
+}
+
+func TestTokenPool(t *testing.T) {
+	authz := getGitHubAuthorizerPool()
+
+	// Credentials which have not been observed are preferred.
+	first := roundTrip(t, authz, "/api/v3/repos/org/repo", 100)
+	second := roundTrip(t, authz, "/api/v3/repos/org/repo", 200)
+	require.NotEqual(t, first, second)
+
+	// The credential with the most remaining budget is used.
+	require.Equal(t, second, roundTrip(t, authz, "/api/v3/repos/org/repo", 50))
+	require.Equal(t, first, roundTrip(t, authz, "/api/v3/repos/org/repo", 50))
+
+	// GraphQL has a separate budget.
+	require.Equal(t, "bearer first", roundTrip(t, authz, "/graphql", 10))
+	require.Equal(t, "bearer second", roundTrip(t, authz, "/graphql", 10))
+}
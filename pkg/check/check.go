@@ -0,0 +1,225 @@
+// Package check finds mistakes in a configuration which validates but does not behave as intended.
+package check
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-crypt/crypt"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+type Severity string
+
+const (
+	// SeverityError is a finding which prevents the proxy from running or from checking client tokens.
+	SeverityError Severity = "error"
+	// SeverityWarning is a finding which is most likely not intended.
+	SeverityWarning Severity = "warning"
+)
+
+// Finding is a single problem of a configuration, Policy is empty if it applies to the whole configuration.
+type Finding struct {
+	Severity Severity
+	Policy   string
+	Message  string
+}
+
+func (f Finding) String() string {
+	if f.Policy == "" {
+		return fmt.Sprintf("%s: %s", f.Severity, f.Message)
+	}
+	return fmt.Sprintf("%s: policy %s: %s", f.Severity, f.Policy, f.Message)
+}
+
+// Configuration checks a loaded configuration and returns its findings in the order of the policies.
+func Configuration(cfg *config.Configuration) []Finding {
+	findings := []Finding{}
+	supported := &config.Configuration{}
+	ids := map[string]bool{}
+	for _, p := range cfg.Policies {
+		if p.Provider == config.ForgejoProviderType {
+			findings = append(findings, errorf(p, "provider %s is not supported by the proxy", p.Provider))
+		} else {
+			supported.Policies = append(supported.Policies, p)
+		}
+		id := p.Host + "//" + p.ID
+		if ids[id] {
+			findings = append(findings, errorf(p, "id is used by another policy for host %s", p.Host))
+		}
+		ids[id] = true
+		// References to secrets are not resolved when checking a configuration
+		if p.UserAuth.TokenHash != "" && !config.ContainsReference(p.UserAuth.TokenHash) {
+			if _, err := crypt.Decode(p.UserAuth.TokenHash); err != nil {
+				findings = append(findings, errorf(p, "token hash uses an unsupported algorithm: %v", err))
+			}
+		}
+		findings = append(findings, unreachableRules(p)...)
+	}
+	if _, err := auth.NewAuthorizer(supported); err != nil {
+		findings = append(findings, Finding{Severity: SeverityError, Message: fmt.Sprintf("could not generate authorization: %v", err)})
+	}
+	for i, p := range cfg.Policies {
+		for _, q := range cfg.Policies[:i] {
+			// Tokens are checked against the policies of every host, so the hash may not be reused across hosts either
+			if p.UserAuth.TokenHash != "" && p.UserAuth.TokenHash == q.UserAuth.TokenHash {
+				findings = append(findings, warningf(p, "token hash is also used by policy %s, clients are authorized by both policies", q.ID))
+			}
+			findings = append(findings, overlappingWildcards(q, p)...)
+		}
+	}
+	return findings
+}
+
+// HasErrors returns true if any of the findings is an error.
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteReport writes a human readable report of the policies and findings.
+func WriteReport(w io.Writer, cfg *config.Configuration, findings []Finding) error {
+	for _, p := range cfg.Policies {
+		_, err := fmt.Fprintf(w, "policy %s: provider %s, host %s, %s, %s mode, %d repositories, %d api routes\n",
+			p.ID, p.Provider, p.Host, clientDescription(p), mode(p), len(p.Repositories), len(p.APIRoutes))
+		if err != nil {
+			return err
+		}
+	}
+	errors := 0
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			errors++
+		}
+		if _, err := fmt.Fprintln(w, f.String()); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d policies, %d errors, %d warnings\n", len(cfg.Policies), errors, len(findings)-errors)
+	return err
+}
+
+// unreachableRules returns rules of the policy which can never permit a request.
+func unreachableRules(p *config.Policy) []Finding {
+	findings := []Finding{}
+	for i, r := range p.Repositories {
+		for j, other := range p.Repositories {
+			if i == j || !covers(other, r) {
+				continue
+			}
+			// Of two identical entries only the second is reported
+			if covers(r, other) && j > i {
+				continue
+			}
+			findings = append(findings, warningf(p, "repository %s is unreachable, it is covered by repository %s",
+				repositoryName(r), repositoryName(other)))
+			break
+		}
+	}
+	if p.ReadOnly || p.UserAuth.Anonymous {
+		for _, route := range p.APIRoutes {
+			fields := strings.Fields(route)
+			if len(fields) == 0 {
+				continue
+			}
+			switch strings.ToUpper(fields[0]) {
+			case "*", http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				findings = append(findings, warningf(p, "api route %q is unreachable, the policy is read only", route))
+			}
+		}
+	}
+	return findings
+}
+
+// overlappingWildcards returns the repositories of the policies which are covered by a wildcard
+// repository of the other policy, if a client can be authorized by both policies.
+func overlappingWildcards(first, second *config.Policy) []Finding {
+	if first.Host != second.Host || !shareClients(first, second) {
+		return nil
+	}
+	findings := []Finding{}
+	for _, pair := range [][2]*config.Policy{{first, second}, {second, first}} {
+		for _, wildcard := range pair[0].Repositories {
+			if !isWildcard(wildcard) {
+				continue
+			}
+			for _, r := range pair[1].Repositories {
+				if covers(wildcard, r) {
+					findings = append(findings, warningf(second, "repository %s of policy %s overlaps repository %s of policy %s",
+						repositoryName(wildcard), pair[0].ID, repositoryName(r), pair[1].ID))
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// shareClients returns true if a single client can be authorized by both policies.
+func shareClients(p, q *config.Policy) bool {
+	if p.UserAuth.Anonymous || q.UserAuth.Anonymous {
+		return true
+	}
+	if p.UserAuth.TokenHash != "" && p.UserAuth.TokenHash == q.UserAuth.TokenHash {
+		return true
+	}
+	return p.UserAuth.ClientCert != nil && q.UserAuth.ClientCert != nil && *p.UserAuth.ClientCert == *q.UserAuth.ClientCert
+}
+
+func isWildcard(r *config.Repository) bool {
+	return r.Owner == "" || r.Owner == "*" || r.Name == "*"
+}
+
+// covers returns true if every repository matched by r is also matched by c.
+func covers(c, r *config.Repository) bool {
+	ownerWildcard := c.Owner == "" || c.Owner == "*"
+	if !ownerWildcard && (r.Owner == "" || r.Owner == "*" || !strings.EqualFold(c.Owner, r.Owner)) {
+		return false
+	}
+	return c.Name == "*" || (r.Name != "*" && strings.EqualFold(c.Name, r.Name))
+}
+
+func repositoryName(r *config.Repository) string {
+	owner := r.Owner
+	if owner == "" {
+		owner = "*"
+	}
+	return owner + "/" + r.Name
+}
+
+func clientDescription(p *config.Policy) string {
+	clients := []string{}
+	if p.UserAuth.Anonymous {
+		clients = append(clients, "anonymous")
+	}
+	if p.UserAuth.TokenHash != "" {
+		clients = append(clients, "token")
+	}
+	if p.UserAuth.ClientCert != nil {
+		clients = append(clients, "client certificate")
+	}
+	return strings.Join(clients, " and ") + " clients"
+}
+
+func mode(p *config.Policy) string {
+	if p.Mode == "" {
+		return config.PolicyModeEnforce
+	}
+	return p.Mode
+}
+
+func errorf(p *config.Policy, format string, a ...any) Finding {
+	return Finding{Severity: SeverityError, Policy: p.ID, Message: fmt.Sprintf(format, a...)}
+}
+
+func warningf(p *config.Policy, format string, a ...any) Finding {
+	return Finding{Severity: SeverityWarning, Policy: p.ID, Message: fmt.Sprintf(format, a...)}
+}
@@ -0,0 +1,200 @@
+package check
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+// mkpasswd -m sha512crypt incoming-test-token
+const testTokenHash = "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou."
+
+func TestConfiguration(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []*config.Policy
+		expected []Finding
+	}{
+		{
+			name: "valid",
+			policies: []*config.Policy{
+				{
+					ID:           "dev",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{{Owner: "org", Name: "*"}},
+				},
+				{
+					ID:           "prod",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{ClientCert: &config.ClientCert{Subject: "CN=flux"}},
+					Repositories: []*config.Repository{{Owner: "org", Name: "prod"}},
+				},
+			},
+			expected: []Finding{},
+		},
+		{
+			name: "forgejo provider",
+			policies: []*config.Policy{
+				{
+					ID:           "forgejo",
+					Provider:     config.ForgejoProviderType,
+					Host:         "codeberg.org",
+					UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+				},
+			},
+			expected: []Finding{
+				{Severity: SeverityError, Policy: "forgejo", Message: "provider forgejo is not supported by the proxy"},
+			},
+		},
+		{
+			name: "unsupported hash algorithm",
+			policies: []*config.Policy{
+				{
+					ID:           "md5",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{TokenHash: "$1$saltsalt$qjXMvbEw8oaL.CzflDugX/"},
+					Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+				},
+			},
+			expected: []Finding{
+				{Severity: SeverityError, Policy: "md5", Message: "token hash uses an unsupported algorithm: provided encoded hash has an invalid identifier: the identifier '1' is unknown to the global decoder"},
+			},
+		},
+		{
+			name: "duplicate token hash",
+			policies: []*config.Policy{
+				{
+					ID:           "first",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{{Owner: "org", Name: "first"}},
+				},
+				{
+					ID:           "second",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{{Owner: "org", Name: "second"}},
+				},
+			},
+			expected: []Finding{
+				{Severity: SeverityWarning, Policy: "second", Message: "token hash is also used by policy first, clients are authorized by both policies"},
+			},
+		},
+		{
+			name: "overlapping wildcard",
+			policies: []*config.Policy{
+				{
+					ID:           "public",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{Anonymous: true},
+					Repositories: []*config.Repository{{Owner: "org", Name: "*"}},
+				},
+				{
+					ID:           "dev",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{{Owner: "org", Name: "repo"}, {Owner: "other", Name: "repo"}},
+				},
+				{
+					ID:           "enterprise",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.example.com",
+					UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+				},
+			},
+			expected: []Finding{
+				{Severity: SeverityWarning, Policy: "dev", Message: "repository org/* of policy public overlaps repository org/repo of policy dev"},
+				{Severity: SeverityWarning, Policy: "enterprise", Message: "token hash is also used by policy dev, clients are authorized by both policies"},
+			},
+		},
+		{
+			name: "unreachable rules",
+			policies: []*config.Policy{
+				{
+					ID:       "dev",
+					Provider: config.GitHubProviderType,
+					Host:     "github.com",
+					UserAuth: config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{
+						{Owner: "org", Name: "repo"},
+						{Owner: "*", Name: "*"},
+						{Owner: "other", Name: "repo"},
+						{Owner: "other", Name: "repo"},
+					},
+					APIRoutes: []string{"GET /orgs/org/teams", "POST /orgs/org/teams"},
+					ReadOnly:  true,
+				},
+			},
+			expected: []Finding{
+				{Severity: SeverityWarning, Policy: "dev", Message: "repository org/repo is unreachable, it is covered by repository */*"},
+				{Severity: SeverityWarning, Policy: "dev", Message: "repository other/repo is unreachable, it is covered by repository */*"},
+				{Severity: SeverityWarning, Policy: "dev", Message: "repository other/repo is unreachable, it is covered by repository */*"},
+				{Severity: SeverityWarning, Policy: "dev", Message: "api route \"POST /orgs/org/teams\" is unreachable, the policy is read only"},
+			},
+		},
+		{
+			name: "invalid api route",
+			policies: []*config.Policy{
+				{
+					ID:           "dev",
+					Provider:     config.GitHubProviderType,
+					Host:         "github.com",
+					UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+					Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+					APIRoutes:    []string{"/orgs/org/teams"},
+				},
+			},
+			expected: []Finding{
+				{Severity: SeverityError, Message: "could not generate authorization: could not parse api route of policy dev: invalid api route \"/orgs/org/teams\": expected method and path"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findings := Configuration(&config.Configuration{Policies: tt.policies})
+			require.Equal(t, tt.expected, findings)
+		})
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:           "dev",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Mode:         config.PolicyModeAudit,
+				UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+				Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+			},
+		},
+	}
+	findings := []Finding{
+		{Severity: SeverityError, Policy: "dev", Message: "broken"},
+		{Severity: SeverityWarning, Message: "suspicious"},
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteReport(buf, cfg, findings))
+	expected := `policy dev: provider github, host github.com, token clients, audit mode, 1 repositories, 0 api routes
+error: policy dev: broken
+warning: suspicious
+1 policies, 1 errors, 1 warnings
+`
+	require.Equal(t, expected, buf.String())
+	require.True(t, HasErrors(findings))
+	require.False(t, HasErrors(findings[1:]))
+}
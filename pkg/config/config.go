@@ -2,15 +2,28 @@ package config
 
 import (
 	"encoding/json"
+	"path/filepath"
+	"strings"
 
 	"github.com/go-playground/validator/v10"
+	"github.com/pelletier/go-toml/v2"
 	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
 )
 
 const (
 	defaultScheme      = "https"
 	standardGitHub     = "github.com"
 	GitHubProviderType = "github"
+	// ForgejoProviderType passes validation but is not supported by the proxy yet.
+	ForgejoProviderType = "forgejo"
+)
+
+const (
+	// PolicyModeEnforce denies requests which are not permitted by the policy.
+	PolicyModeEnforce = "enforce"
+	// PolicyModeAudit proxies requests which are not permitted by the policy and reports them as would-be denials.
+	PolicyModeAudit = "audit"
 )
 
 type ProviderType string
@@ -28,14 +41,69 @@ type Policy struct {
 	Scheme       string        `json:"scheme,omitempty" validate:"required"`
 	UserAuth     UserAuth      `json:"userAuth" validate:"required,dive"`
 	Repositories []*Repository `json:"repositories" validate:"required,dive"`
+	// APIRoutes are API routes permitted in addition to the repository routes, for example "GET /orgs/acme/teams".
+	// A "*" segment matches a single path segment and a trailing "**" segment matches the remainder of the path.
+	APIRoutes []string `json:"apiRoutes,omitempty" validate:"omitempty,dive,required"`
+	// ReadOnly only permits requests which do not modify the repositories, anonymous policies are always read only.
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Mode is either enforce or audit. A policy in audit mode still proxies the requests it would deny,
+	// anonymous policies cannot use audit mode.
+	Mode      string     `json:"mode,omitempty" validate:"required,oneof=enforce audit"`
+	RateLimit *RateLimit `json:"rateLimit,omitempty"`
+	Upstream  *Upstream  `json:"upstream,omitempty"`
+}
+
+// Upstream configures the connections to the upstream of a policy.
+type Upstream struct {
+	// CAFile is a CA bundle trusted in addition to the system roots.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are the client certificate presented to the upstream.
+	CertFile string `json:"certFile,omitempty" validate:"required_with=KeyFile"`
+	KeyFile  string `json:"keyFile,omitempty" validate:"required_with=CertFile"`
+	// InsecureSkipVerify disables verification of the upstream certificate, it should only be used for testing.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// Proxy is the URL of an egress proxy, the HTTPS_PROXY and NO_PROXY environment variables are used if it is not set.
+	Proxy string `json:"proxy,omitempty" validate:"omitempty,url"`
+}
+
+// RateLimit limits the requests of all clients of a policy, zero values are unlimited.
+type RateLimit struct {
+	RequestsPerMinute float64 `json:"requestsPerMinute,omitempty" validate:"gte=0"`
+	// Burst is the number of requests permitted at once before the rate applies, defaults to one.
+	Burst         int `json:"burst,omitempty" validate:"gte=0"`
+	MaxConcurrent int `json:"maxConcurrent,omitempty" validate:"gte=0"`
 }
 
+// UserAuth selects the clients a policy applies to. Either a token hash, a client certificate
+// or both have to be configured, unless the policy permits anonymous access.
 type UserAuth struct {
-	TokenHash string `json:"tokenHash"`
+	TokenHash  string      `json:"tokenHash" validate:"required_without_all=ClientCert Anonymous,excluded_with=Anonymous"`
+	ClientCert *ClientCert `json:"clientCert,omitempty" validate:"omitempty,excluded_with=Anonymous"`
+	// Anonymous applies the policy to requests without any credentials.
+	Anonymous bool `json:"anonymous,omitempty"`
+}
+
+// ClientCert selects a policy by the attributes of a verified TLS client certificate.
+// All attributes that are set have to match.
+type ClientCert struct {
+	Subject  string `json:"subject,omitempty" validate:"required_without_all=URI SPIFFEID"`
+	URI      string `json:"uri,omitempty"`
+	SPIFFEID string `json:"spiffeId,omitempty" validate:"omitempty,startswith=spiffe://"`
 }
 
 type GitHub struct {
 	Token string `json:"token"`
+	// Tokens is a pool of upstream tokens, each request uses the token with the most remaining rate limit.
+	Tokens []string `json:"tokens,omitempty" validate:"omitempty,dive,required"`
+}
+
+// GetTokens returns all upstream tokens of the policy. A policy without tokens has a single empty token.
+func (g GitHub) GetTokens() []string {
+	tokens := []string{}
+	if g.Token != "" || len(g.Tokens) == 0 {
+		tokens = append(tokens, g.Token)
+	}
+	return append(tokens, g.Tokens...)
 }
 
 type Repository struct {
@@ -48,6 +116,9 @@ func setConfigurationDefaults(cfg *Configuration) *Configuration {
 		if p.Scheme == "" {
 			cfg.Policies[i].Scheme = defaultScheme
 		}
+		if p.Mode == "" {
+			cfg.Policies[i].Mode = PolicyModeEnforce
+		}
 		if p.Provider == GitHubProviderType && p.Host == "" {
 			p.Host = standardGitHub
 		}
@@ -55,18 +126,47 @@ func setConfigurationDefaults(cfg *Configuration) *Configuration {
 	return cfg
 }
 
-// LoadConfiguration parses and validates the configuration file at a given path.
-func LoadConfiguration(fs afero.Fs, path string) (*Configuration, error) {
+// LoadOption changes how LoadConfiguration loads a configuration.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	resolveSecrets bool
+}
+
+// WithoutSecrets keeps the references in secret fields instead of replacing them with their values, only their
+// syntax is validated. It is meant for tools which inspect a configuration without access to its secrets.
+func WithoutSecrets() LoadOption {
+	return func(o *loadOptions) {
+		o.resolveSecrets = false
+	}
+}
+
+// LoadConfiguration parses and validates the configuration file at a given path. Files with a .yaml or .yml
+// extension are parsed as YAML, files with a .toml extension as TOML and all other files as JSON. References to
+// environment variables and files in secret fields are replaced with their values.
+func LoadConfiguration(fs afero.Fs, path string, opts ...LoadOption) (*Configuration, error) {
+	o := &loadOptions{resolveSecrets: true}
+	for _, opt := range opts {
+		opt(o)
+	}
 	b, err := afero.ReadFile(fs, path)
 	if err != nil {
 		return nil, err
 	}
+	b, err = toJSON(b, filepath.Ext(path))
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := &Configuration{}
 	err = json.Unmarshal(b, &cfg)
 	if err != nil {
 		return nil, err
 	}
+	err = interpolateSecrets(fs, cfg, o.resolveSecrets)
+	if err != nil {
+		return nil, err
+	}
 	cfg = setConfigurationDefaults(cfg)
 
 	validate := validator.New()
@@ -76,3 +176,21 @@ func LoadConfiguration(fs afero.Fs, path string) (*Configuration, error) {
 	}
 	return cfg, nil
 }
+
+// toJSON converts YAML and TOML documents to JSON, so that all formats are decoded with the JSON field names.
+func toJSON(b []byte, ext string) ([]byte, error) {
+	var v any
+	switch strings.ToLower(ext) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		if err := toml.Unmarshal(b, &v); err != nil {
+			return nil, err
+		}
+	default:
+		return b, nil
+	}
+	return json.Marshal(v)
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/spf13/afero"
@@ -46,6 +47,9 @@ const validGitHub = `
         "token": "foobar"
       },
 			"host": "github.com",
+			"userAuth": {
+				"tokenHash": "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou."
+			},
 			"repositories": [
 				{
 					"owner": "example",
@@ -72,3 +76,306 @@ func TestValidGitHub(t *testing.T) {
 	require.Equal(t, "gitops-deployment", cfg.Policies[0].Repositories[0].Name)
 	require.Equal(t, "example", cfg.Policies[0].Repositories[0].Owner)
 }
+
+const validClientCert = `
+{
+	"policies": [
+		{
+			"id": "123",
+			"provider": "github",
+			"userAuth": {
+				"clientCert": {
+					"spiffeId": "spiffe://cluster.local/ns/flux-system/sa/source-controller"
+				}
+			},
+			"repositories": [
+				{
+					"owner": "example",
+					"name": "gitops-deployment"
+				}
+			]
+		}
+	]
+}
+`
+
+func TestValidClientCert(t *testing.T) {
+	fs, path, err := fsWithContent(validClientCert)
+	require.NoError(t, err)
+	cfg, err := LoadConfiguration(fs, path)
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Policies[0].UserAuth.ClientCert)
+	require.Equal(t, "spiffe://cluster.local/ns/flux-system/sa/source-controller", cfg.Policies[0].UserAuth.ClientCert.SPIFFEID)
+}
+
+const invalidClientCert = `
+{
+	"policies": [
+		{
+			"id": "123",
+			"provider": "github",
+			"userAuth": {
+				"clientCert": {
+					"spiffeId": "https://example.com"
+				}
+			},
+			"repositories": [
+				{
+					"owner": "example",
+					"name": "gitops-deployment"
+				}
+			]
+		}
+	]
+}
+`
+
+func TestInvalidClientCert(t *testing.T) {
+	fs, path, err := fsWithContent(invalidClientCert)
+	require.NoError(t, err)
+	_, err = LoadConfiguration(fs, path)
+	require.Error(t, err)
+}
+
+const validAnonymous = `
+{
+	"policies": [
+		{
+			"id": "public",
+			"provider": "github",
+			"userAuth": {
+				"anonymous": true
+			},
+			"repositories": [
+				{
+					"owner": "*",
+					"name": "*"
+				}
+			]
+		}
+	]
+}
+`
+
+func TestValidAnonymous(t *testing.T) {
+	fs, path, err := fsWithContent(validAnonymous)
+	require.NoError(t, err)
+	cfg, err := LoadConfiguration(fs, path)
+	require.NoError(t, err)
+	require.True(t, cfg.Policies[0].UserAuth.Anonymous)
+}
+
+const implicitAnonymous = `
+{
+	"policies": [
+		{
+			"id": "public",
+			"provider": "github",
+			"userAuth": {
+				"tokenHash": ""
+			},
+			"repositories": [
+				{
+					"owner": "*",
+					"name": "*"
+				}
+			]
+		}
+	]
+}
+`
+
+func TestImplicitAnonymous(t *testing.T) {
+	fs, path, err := fsWithContent(implicitAnonymous)
+	require.NoError(t, err)
+	_, err = LoadConfiguration(fs, path)
+	require.Error(t, err)
+}
+
+const anonymousWithTokenHash = `
+{
+	"policies": [
+		{
+			"id": "public",
+			"provider": "github",
+			"userAuth": {
+				"tokenHash": "foo",
+				"anonymous": true
+			},
+			"repositories": [
+				{
+					"owner": "*",
+					"name": "*"
+				}
+			]
+		}
+	]
+}
+`
+
+func TestAnonymousWithTokenHash(t *testing.T) {
+	fs, path, err := fsWithContent(anonymousWithTokenHash)
+	require.NoError(t, err)
+	_, err = LoadConfiguration(fs, path)
+	require.Error(t, err)
+}
+
+const validYAML = `
+policies:
+  - id: "123"
+    provider: github
+    github:
+      token: ${GITHUB_TOKEN}
+      tokens:
+        - ${file:/var/secrets/github/token}
+    host: github.com
+    userAuth:
+      tokenHash: ${file:/var/secrets/token-hash}
+    repositories:
+      - owner: example
+        name: gitops-deployment
+`
+
+const validTOML = `
+[[policies]]
+id = "123"
+provider = "github"
+host = "github.com"
+readOnly = true
+
+[policies.github]
+token = "prefix-${GITHUB_TOKEN}"
+
+[policies.userAuth]
+tokenHash = "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou."
+
+[[policies.repositories]]
+owner = "example"
+name = "gitops-deployment"
+`
+
+func TestFormatsAndInterpolation(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "env-token")
+	tokenHash := "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou."
+
+	tests := []struct {
+		name     string
+		path     string
+		content  string
+		expected *Policy
+	}{
+		{
+			name:    "yaml",
+			path:    "config.yaml",
+			content: validYAML,
+			expected: &Policy{
+				ID:           "123",
+				Provider:     GitHubProviderType,
+				GitHub:       GitHub{Token: "env-token", Tokens: []string{"file-token"}},
+				Host:         "github.com",
+				Scheme:       defaultScheme,
+				Mode:         PolicyModeEnforce,
+				UserAuth:     UserAuth{TokenHash: tokenHash},
+				Repositories: []*Repository{{Owner: "example", Name: "gitops-deployment"}},
+			},
+		},
+		{
+			name:    "toml",
+			path:    "config.toml",
+			content: validTOML,
+			expected: &Policy{
+				ID:           "123",
+				Provider:     GitHubProviderType,
+				GitHub:       GitHub{Token: "prefix-env-token"},
+				Host:         "github.com",
+				Scheme:       defaultScheme,
+				Mode:         PolicyModeEnforce,
+				UserAuth:     UserAuth{TokenHash: tokenHash},
+				Repositories: []*Repository{{Owner: "example", Name: "gitops-deployment"}},
+				ReadOnly:     true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, tt.path, []byte(tt.content), 0o600))
+			require.NoError(t, afero.WriteFile(fs, "/var/secrets/github/token", []byte("file-token\n"), 0o600))
+			require.NoError(t, afero.WriteFile(fs, "/var/secrets/token-hash", []byte(tokenHash), 0o600))
+			cfg, err := LoadConfiguration(fs, tt.path)
+			require.NoError(t, err)
+			require.Equal(t, []*Policy{tt.expected}, cfg.Policies)
+		})
+	}
+}
+
+func TestInterpolationErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{
+			name:     "missing environment variable",
+			token:    "${GIT_AUTH_PROXY_MISSING_TOKEN}",
+			expected: "could not interpolate secret of policy 123: environment variable GIT_AUTH_PROXY_MISSING_TOKEN is not set",
+		},
+		{
+			name:     "missing file",
+			token:    "${file:/var/secrets/missing}",
+			expected: "could not interpolate secret of policy 123: could not read /var/secrets/missing: open /var/secrets/missing: file does not exist",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := strings.Replace(validYAML, "${GITHUB_TOKEN}", tt.token, 1)
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, "config.yml", []byte(content), 0o600))
+			require.NoError(t, afero.WriteFile(fs, "/var/secrets/github/token", []byte("file-token"), 0o600))
+			require.NoError(t, afero.WriteFile(fs, "/var/secrets/token-hash", []byte("hash"), 0o600))
+			_, err := LoadConfiguration(fs, "config.yml")
+			require.EqualError(t, err, tt.expected)
+		})
+	}
+}
+
+func TestWithoutSecrets(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "config.yml", []byte(validYAML), 0o600))
+	cfg, err := LoadConfiguration(fs, "config.yml", WithoutSecrets())
+	require.NoError(t, err)
+	require.Equal(t, "${GITHUB_TOKEN}", cfg.Policies[0].GitHub.Token)
+	require.Equal(t, []string{"${file:/var/secrets/github/token}"}, cfg.Policies[0].GitHub.Tokens)
+	require.Equal(t, "${file:/var/secrets/token-hash}", cfg.Policies[0].UserAuth.TokenHash)
+
+	tests := []struct {
+		name     string
+		token    string
+		expected string
+	}{
+		{
+			name:     "empty environment variable",
+			token:    "${}",
+			expected: "invalid secret reference of policy 123: reference ${} has no environment variable",
+		},
+		{
+			name:     "empty file path",
+			token:    "${file:}",
+			expected: "invalid secret reference of policy 123: reference ${file:} has no file path",
+		},
+		{
+			name:     "unterminated reference",
+			token:    "${GITHUB_TOKEN",
+			expected: "invalid secret reference of policy 123: reference is not terminated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := strings.Replace(validYAML, "${GITHUB_TOKEN}", tt.token, 1)
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, "config.yml", []byte(content), 0o600))
+			_, err := LoadConfiguration(fs, "config.yml", WithoutSecrets())
+			require.EqualError(t, err, tt.expected)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const filePrefix = "file:"
+
+// referencePattern matches references to environment variables, ${NAME}, and to files, ${file:/path}.
+var referencePattern = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// interpolateSecrets replaces references in the upstream tokens and token hashes with their values,
+// so that secrets do not have to be part of the configuration file. If resolve is false the references
+// are only validated and kept.
+func interpolateSecrets(fs afero.Fs, cfg *Configuration, resolve bool) error {
+	for _, p := range cfg.Policies {
+		if p == nil {
+			continue
+		}
+		fields := []*string{&p.GitHub.Token, &p.UserAuth.TokenHash}
+		for i := range p.GitHub.Tokens {
+			fields = append(fields, &p.GitHub.Tokens[i])
+		}
+		for _, field := range fields {
+			if !resolve {
+				if err := validateReferences(*field); err != nil {
+					return fmt.Errorf("invalid secret reference of policy %s: %w", p.ID, err)
+				}
+				continue
+			}
+			value, err := interpolate(fs, *field)
+			if err != nil {
+				return fmt.Errorf("could not interpolate secret of policy %s: %w", p.ID, err)
+			}
+			*field = value
+		}
+	}
+	return nil
+}
+
+// ContainsReference returns true if the value references an environment variable or a file.
+func ContainsReference(s string) bool {
+	return referencePattern.MatchString(s)
+}
+
+// validateReferences returns an error if a reference in the value is malformed.
+func validateReferences(s string) error {
+	for _, match := range referencePattern.FindAllStringSubmatch(s, -1) {
+		ref := match[1]
+		if path, ok := strings.CutPrefix(ref, filePrefix); ok {
+			if path == "" {
+				return fmt.Errorf("reference %s has no file path", match[0])
+			}
+			continue
+		}
+		if ref == "" {
+			return fmt.Errorf("reference %s has no environment variable", match[0])
+		}
+	}
+	if strings.Contains(referencePattern.ReplaceAllString(s, ""), "${") {
+		return errors.New("reference is not terminated")
+	}
+	return nil
+}
+
+func interpolate(fs afero.Fs, s string) (string, error) {
+	if err := validateReferences(s); err != nil {
+		return "", err
+	}
+	var err error
+	result := referencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		if err != nil {
+			return ""
+		}
+		var value string
+		value, err = resolve(fs, referencePattern.FindStringSubmatch(ref)[1])
+		return value
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// resolve returns the value of an environment variable or the content of a file without trailing newlines.
+func resolve(fs afero.Fs, ref string) (string, error) {
+	if path, ok := strings.CutPrefix(ref, filePrefix); ok {
+		b, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s: %w", path, err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", ref)
+	}
+	return value, nil
+}
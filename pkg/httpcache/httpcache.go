@@ -0,0 +1,149 @@
+// Package httpcache caches upstream API responses and revalidates them with conditional requests.
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+)
+
+const (
+	resultHit    = "hit"
+	resultMiss   = "miss"
+	resultBypass = "bypass"
+)
+
+var requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "git_auth_proxy_response_cache_requests_total",
+	Help: "Total number of cacheable upstream requests by result, hits were revalidated with a conditional request.",
+}, []string{"result"})
+
+type scopeContextKey struct{}
+
+// WithScope marks the request as cacheable within the scope. Responses are never shared
+// between scopes, the scope should identify the policy the request was authorized by.
+func WithScope(ctx context.Context, scope string) context.Context {
+	return context.WithValue(ctx, scopeContextKey{}, scope)
+}
+
+func scopeFromContext(ctx context.Context) (string, bool) {
+	scope, ok := ctx.Value(scopeContextKey{}).(string)
+	return scope, ok && scope != ""
+}
+
+// Transport caches responses of GET requests which have a scope, and revalidates them with
+// If-None-Match or If-Modified-Since. A 304 Not Modified response is answered from the cache.
+type Transport struct {
+	Next  http.RoundTripper
+	Store Store
+	// MaxBodySize is the largest response body which is cached.
+	MaxBodySize int64
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scope, ok := scopeFromContext(req.Context())
+	if !ok || req.Method != http.MethodGet {
+		return t.Next.RoundTrip(req)
+	}
+	// Conditional requests of the client are passed through as the client has its own cache
+	if req.Header.Get("If-None-Match") != "" || req.Header.Get("If-Modified-Since") != "" || req.Header.Get("Range") != "" {
+		requestsTotal.WithLabelValues(resultBypass).Inc()
+		return t.Next.RoundTrip(req)
+	}
+
+	key := cacheKey(scope, req)
+	entry, cached := t.Store.Get(key)
+	if cached {
+		req = req.Clone(req.Context())
+		if entry.ETag != "" {
+			req.Header.Set("If-None-Match", entry.ETag)
+		}
+		if entry.LastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.LastModified)
+		}
+	}
+	resp, err := t.Next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if cached && resp.StatusCode == http.StatusNotModified {
+		requestsTotal.WithLabelValues(resultHit).Inc()
+		return entry.response(req, resp), nil
+	}
+	requestsTotal.WithLabelValues(resultMiss).Inc()
+	if resp.StatusCode != http.StatusOK || (resp.Header.Get("ETag") == "" && resp.Header.Get("Last-Modified") == "") {
+		return resp, nil
+	}
+	if resp.ContentLength > t.MaxBodySize {
+		return resp, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, t.MaxBodySize+1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > t.MaxBodySize {
+		// Serve the part which has been read followed by the rest of the body
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	t.Store.Set(key, &Entry{
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		Body:         body,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	})
+	return resp, nil
+}
+
+// response returns the cached response, updated with the headers of the not modified response.
+func (e *Entry) response(req *http.Request, notModified *http.Response) *http.Response {
+	//nolint: errcheck //ignore
+	io.Copy(io.Discard, notModified.Body)
+	notModified.Body.Close()
+	header := e.Header.Clone()
+	for k, v := range notModified.Header {
+		if k == "Content-Length" || k == "Content-Encoding" || k == "Content-Type" {
+			continue
+		}
+		header[k] = v
+	}
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	return &http.Response{
+		Status:        strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode),
+		StatusCode:    e.StatusCode,
+		Proto:         notModified.Proto,
+		ProtoMajor:    notModified.ProtoMajor,
+		ProtoMinor:    notModified.ProtoMinor,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+}
+
+// cacheKey identifies a response by scope, upstream credential, URL and the headers GitHub varies responses by.
+func cacheKey(scope string, req *http.Request) string {
+	return strings.Join([]string{
+		scope,
+		auth.UpstreamCredentialLabel(req.Context()),
+		req.URL.String(),
+		req.Header.Get("Accept"),
+		req.Header.Get("Accept-Encoding"),
+		req.Header.Get("X-GitHub-Api-Version"),
+	}, "\n")
+}
@@ -0,0 +1,241 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestTransport(t *testing.T) {
+	upstreamRequests := 0
+	notModified := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests++
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "application/json")
+		//nolint: errcheck //ignore
+		w.Write([]byte(`{"name":"repo"}`))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name          string
+		stores        []Store
+		scope         string
+		authorization string
+		header        http.Header
+		notModified   int
+	}{
+		{
+			name:          "memory",
+			stores:        []Store{NewMemoryStore(10)},
+			scope:         "policy",
+			authorization: "token a",
+			notModified:   1,
+		},
+		{
+			name: "disk",
+			stores: func() []Store {
+				dir := t.TempDir()
+				first, err := NewDiskStore(dir, 0)
+				require.NoError(t, err)
+				second, err := NewDiskStore(dir, 0)
+				require.NoError(t, err)
+				return []Store{first, second}
+			}(),
+			scope:         "policy",
+			authorization: "token a",
+			notModified:   1,
+		},
+		{
+			name:          "different scopes",
+			stores:        []Store{NewMemoryStore(10), NewMemoryStore(10)},
+			scope:         "policy",
+			authorization: "token a",
+			notModified:   0,
+		},
+		{
+			name:          "no scope",
+			stores:        []Store{NewMemoryStore(10)},
+			authorization: "token a",
+			notModified:   0,
+		},
+		{
+			name:          "client conditional request",
+			stores:        []Store{NewMemoryStore(10)},
+			scope:         "policy",
+			authorization: "token a",
+			header:        http.Header{"If-None-Match": []string{`"v0"`}},
+			notModified:   0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamRequests = 0
+			notModified = 0
+			shared := tt.stores[0]
+			for i := 0; i < 2; i++ {
+				store := shared
+				if len(tt.stores) > 1 {
+					store = tt.stores[i]
+				}
+				transport := &Transport{Next: http.DefaultTransport, Store: store, MaxBodySize: 1024}
+				ctx := context.Background()
+				if tt.scope != "" {
+					ctx = WithScope(ctx, tt.scope)
+				}
+				req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstream.URL+"/repos/org/repo", nil)
+				require.NoError(t, err)
+				for k, v := range tt.header {
+					req.Header[k] = v
+				}
+				req.Header.Set("Authorization", tt.authorization)
+				resp, err := transport.RoundTrip(req)
+				require.NoError(t, err)
+				body, err := io.ReadAll(resp.Body)
+				require.NoError(t, err)
+				resp.Body.Close()
+				require.Equal(t, http.StatusOK, resp.StatusCode)
+				require.Equal(t, `{"name":"repo"}`, string(body))
+				require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+				require.Equal(t, "4999", resp.Header.Get("X-RateLimit-Remaining"))
+			}
+			require.Equal(t, 2, upstreamRequests)
+			require.Equal(t, tt.notModified, notModified)
+		})
+	}
+}
+
+func TestTransportCredentials(t *testing.T) {
+	conditional := []bool{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conditional = append(conditional, r.Header.Get("If-None-Match") != "")
+		// The first credential has more remaining requests and is preferred once both have been observed
+		remaining := "100"
+		if r.Header.Get("Authorization") == "token first" {
+			remaining = "200"
+		}
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", remaining)
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		if r.Header.Get("If-None-Match") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		//nolint: errcheck //ignore
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	authz, err := auth.NewAuthorizer(&config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:       "pool",
+				Provider: config.GitHubProviderType,
+				GitHub: config.GitHub{
+					Tokens: []string{"first", "second"},
+				},
+				Host:         upstreamURL.Host,
+				Scheme:       upstreamURL.Scheme,
+				Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+				UserAuth: config.UserAuth{
+					Anonymous: true,
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	e, err := authz.GetEndpointById(upstreamURL.Host + "//pool")
+	require.NoError(t, err)
+
+	// Responses are cached per upstream credential, the pooled credentials do not share them.
+	transport := &Transport{Next: http.DefaultTransport, Store: NewMemoryStore(10), MaxBodySize: 1024}
+	for range 3 {
+		req, err := http.NewRequestWithContext(WithScope(context.Background(), e.ID()), http.MethodGet, "http://proxy/api/v3/repos/org/repo", nil)
+		require.NoError(t, err)
+		req, target, err := authz.UpdateRequest(req.Context(), req, e)
+		require.NoError(t, err)
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		authz.ObserveResponse(resp)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, req.Header.Get("Authorization"), string(body))
+	}
+	require.Equal(t, []bool{false, false, true}, conditional)
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	store := NewMemoryStore(2)
+	store.Set("a", &Entry{})
+	store.Set("b", &Entry{})
+	_, ok := store.Get("a")
+	require.True(t, ok)
+	store.Set("c", &Entry{})
+	_, ok = store.Get("b")
+	require.False(t, ok)
+	_, ok = store.Get("a")
+	require.True(t, ok)
+	_, ok = store.Get("c")
+	require.True(t, ok)
+}
+
+func TestDiskStoreEviction(t *testing.T) {
+	dir := t.TempDir()
+	entry := &Entry{StatusCode: http.StatusOK, Body: []byte("body")}
+	b, err := json.Marshal(entry)
+	require.NoError(t, err)
+	store, err := NewDiskStore(dir, int64(2*len(b)))
+	require.NoError(t, err)
+	store.Set("a", entry)
+	store.Set("b", entry)
+	_, ok := store.Get("a")
+	require.True(t, ok)
+	store.Set("c", entry)
+	_, ok = store.Get("b")
+	require.False(t, ok)
+	_, ok = store.Get("a")
+	require.True(t, ok)
+	_, ok = store.Get("c")
+	require.True(t, ok)
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	// The least recently used entries are evicted first when the directory is loaded with a smaller limit.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, tmpPrefix+"partial"), []byte("{"), 0o600))
+	store, err = NewDiskStore(dir, int64(len(b)))
+	require.NoError(t, err)
+	_, ok = store.Get("a")
+	require.False(t, ok)
+	_, ok = store.Get("c")
+	require.True(t, ok)
+	files, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+}
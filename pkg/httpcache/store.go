@@ -0,0 +1,260 @@
+package httpcache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is a cached upstream response.
+type Entry struct {
+	StatusCode   int         `json:"statusCode"`
+	Header       http.Header `json:"header"`
+	Body         []byte      `json:"body"`
+	ETag         string      `json:"etag,omitempty"`
+	LastModified string      `json:"lastModified,omitempty"`
+}
+
+// Store stores cached responses by key.
+type Store interface {
+	Get(key string) (*Entry, bool)
+	Set(key string, entry *Entry)
+}
+
+type memoryItem struct {
+	key   string
+	entry *Entry
+}
+
+// MemoryStore is an in-memory store which evicts the least recently used entries.
+type MemoryStore struct {
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func NewMemoryStore(maxEntries int) *MemoryStore {
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func (m *MemoryStore) Get(key string) (*Entry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, false
+	}
+	m.lru.MoveToFront(el)
+	item, ok := el.Value.(*memoryItem)
+	if !ok {
+		return nil, false
+	}
+	return item.entry, true
+}
+
+func (m *MemoryStore) Set(key string, entry *Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.lru.MoveToFront(el)
+		el.Value = &memoryItem{key: key, entry: entry}
+		return
+	}
+	m.entries[key] = m.lru.PushFront(&memoryItem{key: key, entry: entry})
+	for m.maxEntries > 0 && m.lru.Len() > m.maxEntries {
+		el := m.lru.Back()
+		m.lru.Remove(el)
+		if item, ok := el.Value.(*memoryItem); ok {
+			delete(m.entries, item.key)
+		}
+	}
+}
+
+type diskItem struct {
+	name string
+	size int64
+}
+
+// DiskStore stores entries as files in a directory, so that they survive restarts. The least recently
+// used entries are removed when the files exceed the maximum size, the modification time of the
+// files records their use so that the order is kept across restarts.
+type DiskStore struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	files map[string]*list.Element
+	lru   *list.List
+	size  int64
+}
+
+// NewDiskStore returns a store in the directory, which removes entries once the files exceed maxSize
+// bytes. Zero disables the limit. Existing entries are loaded and temporary files of interrupted
+// writes are removed.
+func NewDiskStore(dir string, maxSize int64) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("could not create cache directory: %w", err)
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read cache directory: %w", err)
+	}
+	infos := []fs.FileInfo{}
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.Type().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(dirEntry.Name(), tmpPrefix) {
+			//nolint: errcheck //ignore
+			os.Remove(filepath.Join(dir, dirEntry.Name()))
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	d := &DiskStore{
+		dir:     dir,
+		maxSize: maxSize,
+		files:   map[string]*list.Element{},
+		lru:     list.New(),
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, info := range infos {
+		d.files[info.Name()] = d.lru.PushFront(&diskItem{name: info.Name(), size: info.Size()})
+		d.size += info.Size()
+	}
+	d.evict()
+	return d, nil
+}
+
+const tmpPrefix = ".tmp-"
+
+func (d *DiskStore) name(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *DiskStore) Get(key string) (*Entry, bool) {
+	name := d.name(key)
+	b, err := os.ReadFile(filepath.Join(d.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	entry := &Entry{}
+	if err := json.Unmarshal(b, entry); err != nil {
+		return nil, false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if el, ok := d.files[name]; ok {
+		d.lru.MoveToFront(el)
+	} else {
+		// The entry was written by another store on the same directory
+		d.files[name] = d.lru.PushFront(&diskItem{name: name, size: int64(len(b))})
+		d.size += int64(len(b))
+	}
+	now := time.Now()
+	//nolint: errcheck //ignore
+	os.Chtimes(filepath.Join(d.dir, name), now, now)
+	d.evict()
+	return entry, true
+}
+
+func (d *DiskStore) Set(key string, entry *Entry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	// Write to a temporary file first so that readers never see a partial entry
+	tmp, err := os.CreateTemp(d.dir, tmpPrefix)
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(b)
+	closeErr := tmp.Close()
+	if err != nil || closeErr != nil {
+		//nolint: errcheck //ignore
+		os.Remove(tmp.Name())
+		return
+	}
+	name := d.name(key)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(d.dir, name)); err != nil {
+		//nolint: errcheck //ignore
+		os.Remove(tmp.Name())
+		return
+	}
+	if el, ok := d.files[name]; ok {
+		d.remove(el)
+	}
+	d.files[name] = d.lru.PushFront(&diskItem{name: name, size: int64(len(b))})
+	d.size += int64(len(b))
+	d.evict()
+}
+
+// evict removes the least recently used files until the size is within the limit, the lock has to be held.
+func (d *DiskStore) evict() {
+	for d.maxSize > 0 && d.size > d.maxSize {
+		el := d.lru.Back()
+		if item, ok := el.Value.(*diskItem); ok {
+			//nolint: errcheck //ignore
+			os.Remove(filepath.Join(d.dir, item.name))
+		}
+		d.remove(el)
+	}
+}
+
+// remove removes the file from the index, the lock has to be held.
+func (d *DiskStore) remove(el *list.Element) {
+	d.lru.Remove(el)
+	if item, ok := el.Value.(*diskItem); ok {
+		delete(d.files, item.name)
+		d.size -= item.size
+	}
+}
+
+// TieredStore reads from the first store and falls back to the second, for example memory in front of disk.
+type TieredStore struct {
+	First  Store
+	Second Store
+}
+
+func (t *TieredStore) Get(key string) (*Entry, bool) {
+	if entry, ok := t.First.Get(key); ok {
+		return entry, true
+	}
+	entry, ok := t.Second.Get(key)
+	if ok {
+		t.First.Set(key, entry)
+	}
+	return entry, ok
+}
+
+func (t *TieredStore) Set(key string, entry *Entry) {
+	t.First.Set(key, entry)
+	t.Second.Set(key, entry)
+}
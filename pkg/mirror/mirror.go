@@ -0,0 +1,311 @@
+// Package mirror keeps local bare mirrors of upstream repositories and serves git-upload-pack from them.
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+)
+
+const uploadPackService = "git-upload-pack"
+
+var (
+	uploadPackPathRegex = regexp.MustCompile(`^/([^/]+)/([^/]+?)(?:\.git)?/(info/refs|git-upload-pack)$`)
+
+	fetchesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_mirror_fetches_total",
+		Help: "Total number of mirror fetches from the upstream by result.",
+	}, []string{"result"})
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_mirror_requests_total",
+		Help: "Total number of upload-pack requests served from mirrors.",
+	}, []string{"type"})
+)
+
+// Config configures the mirror cache.
+type Config struct {
+	// Dir is the directory the bare mirrors are stored in.
+	Dir string
+	// TTL is the age after which a mirror is fetched before advertising its refs.
+	TTL time.Duration
+	// RefreshInterval is the interval at which all mirrors are fetched in the background, zero disables background fetches.
+	RefreshInterval time.Duration
+	// FetchTimeout limits the duration of a single fetch.
+	FetchTimeout time.Duration
+	// GitPath is the path of the git binary.
+	GitPath string
+}
+
+// Upstream describes how to fetch a repository from the upstream.
+type Upstream struct {
+	// Scope separates mirrors fetched with different credentials, such as the policy the upstream belongs to.
+	// A mirror is only served to requests of the scope it was fetched for.
+	Scope string
+	// URL is the clone URL of the repository.
+	URL string
+	// Authorization is the value of the authorization header sent to the upstream.
+	Authorization string
+	// GitConfig contains additional git configuration used when fetching, such as TLS and proxy settings.
+	GitConfig map[string]string
+}
+
+type repository struct {
+	dir string
+
+	mu        sync.Mutex
+	upstream  Upstream
+	lastFetch time.Time
+}
+
+// Cache keeps a bare mirror of every repository requested through it.
+type Cache struct {
+	cfg   Config
+	group singleflight.Group
+
+	mu    sync.Mutex
+	repos map[string]*repository
+}
+
+func NewCache(cfg Config) (*Cache, error) {
+	if cfg.GitPath == "" {
+		gitPath, err := exec.LookPath("git")
+		if err != nil {
+			return nil, fmt.Errorf("git is required for the mirror cache, use the image variant with the -git tag suffix: %w", err)
+		}
+		cfg.GitPath = gitPath
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("could not create mirror directory: %w", err)
+	}
+	return &Cache{
+		cfg:   cfg,
+		repos: map[string]*repository{},
+	}, nil
+}
+
+// ParsePath returns the owner and repository name of upload-pack requests. Only requests
+// which can be served from a mirror are matched, pushes are always sent upstream.
+func ParsePath(req *http.Request) (string, string, bool) {
+	comps := uploadPackPathRegex.FindStringSubmatch(req.URL.Path)
+	if comps == nil {
+		return "", "", false
+	}
+	switch comps[3] {
+	case "info/refs":
+		if req.Method != http.MethodGet || req.URL.Query().Get("service") != uploadPackService {
+			return "", "", false
+		}
+	case uploadPackService:
+		if req.Method != http.MethodPost {
+			return "", "", false
+		}
+	}
+	return comps[1], comps[2], true
+}
+
+// Serve serves the upload-pack request from the mirror of the upstream. The mirror is created
+// or fetched first if it is missing or older than the TTL when refs are advertised. A stale
+// mirror is served if the fetch fails.
+func (c *Cache) Serve(w http.ResponseWriter, req *http.Request, upstream Upstream) error {
+	key, err := mirrorKey(upstream)
+	if err != nil {
+		return err
+	}
+	repo := c.getRepository(key, upstream)
+	advertise := strings.HasSuffix(req.URL.Path, "/info/refs")
+	if advertise && time.Since(repo.getLastFetch()) > c.cfg.TTL {
+		if err := c.fetch(req.Context(), key, repo); err != nil {
+			if repo.getLastFetch().IsZero() {
+				return err
+			}
+			logr.FromContextOrDiscard(req.Context()).Error(err, "serving stale mirror", "repository", key)
+		}
+	}
+	if repo.getLastFetch().IsZero() {
+		return fmt.Errorf("mirror %s has not been fetched", key)
+	}
+
+	suffix := "/git-upload-pack"
+	requestType := "upload-pack"
+	if advertise {
+		suffix = "/info/refs"
+		requestType = "advertise"
+	}
+	// Client credentials must not be passed on to git
+	backendReq := req.Clone(req.Context())
+	backendReq.Header.Del("Authorization")
+	backendReq.Header.Del("Proxy-Authorization")
+	backendReq.URL.Path = "/" + key + suffix
+	handler := &cgi.Handler{
+		Path: c.cfg.GitPath,
+		Args: []string{"http-backend"},
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + c.cfg.Dir,
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+	requestsTotal.WithLabelValues(requestType).Inc()
+	handler.ServeHTTP(w, backendReq)
+	return nil
+}
+
+// Run fetches all mirrors at the refresh interval until the context is cancelled.
+func (c *Cache) Run(ctx context.Context) error {
+	if c.cfg.RefreshInterval <= 0 {
+		return nil
+	}
+	log := logr.FromContextOrDiscard(ctx)
+	ticker := time.NewTicker(c.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			c.mu.Lock()
+			repos := make(map[string]*repository, len(c.repos))
+			for key, repo := range c.repos {
+				repos[key] = repo
+			}
+			c.mu.Unlock()
+			for key, repo := range repos {
+				if err := c.fetch(ctx, key, repo); err != nil {
+					log.Error(err, "could not refresh mirror", "repository", key)
+				}
+			}
+		}
+	}
+}
+
+func (c *Cache) getRepository(key string, upstream Upstream) *repository {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	repo, ok := c.repos[key]
+	if !ok {
+		repo = &repository{dir: filepath.Join(c.cfg.Dir, filepath.FromSlash(key))}
+		c.repos[key] = repo
+	}
+	// The latest credentials of the scope are used for background fetches
+	repo.mu.Lock()
+	repo.upstream = upstream
+	repo.mu.Unlock()
+	return repo
+}
+
+// fetch updates the mirror from the upstream, concurrent fetches of the same mirror are deduplicated.
+func (c *Cache) fetch(ctx context.Context, key string, repo *repository) error {
+	_, err, _ := c.group.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.cfg.FetchTimeout)
+		defer cancel()
+		err := c.runFetch(ctx, repo)
+		if err != nil {
+			fetchesTotal.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		fetchesTotal.WithLabelValues("success").Inc()
+		repo.mu.Lock()
+		repo.lastFetch = time.Now()
+		repo.mu.Unlock()
+		return nil, nil
+	})
+	return err
+}
+
+func (c *Cache) runFetch(ctx context.Context, repo *repository) error {
+	repo.mu.Lock()
+	upstream := repo.upstream
+	repo.mu.Unlock()
+
+	gitConfig := map[string]string{}
+	for k, v := range upstream.GitConfig {
+		gitConfig[k] = v
+	}
+	if upstream.Authorization != "" {
+		gitConfig["http.extraHeader"] = "Authorization: " + upstream.Authorization
+	}
+	// A bare clone maps branches and tags like a mirror and sets HEAD to the default branch,
+	// without fetching other refs such as pull requests.
+	if _, err := os.Stat(filepath.Join(repo.dir, "HEAD")); os.IsNotExist(err) {
+		if err := c.git(ctx, gitConfig, "clone", "--quiet", "--bare", upstream.URL, repo.dir); err != nil {
+			//nolint: errcheck //ignore
+			os.RemoveAll(repo.dir)
+			return err
+		}
+		return nil
+	}
+	return c.git(ctx, gitConfig, "-C", repo.dir, "fetch", "--quiet", "--prune", "--no-tags", upstream.URL,
+		"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*")
+}
+
+// git runs a git command. Configuration is passed through the environment so that credentials do not show up in the process list.
+func (c *Cache) git(ctx context.Context, gitConfig map[string]string, args ...string) error {
+	//nolint: gosec // arguments are not user controlled
+	cmd := exec.CommandContext(ctx, c.cfg.GitPath, args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_CONFIG_COUNT="+strconv.Itoa(len(gitConfig)))
+	i := 0
+	for k, v := range gitConfig {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i, k), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i, v))
+		i++
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+func (r *repository) getLastFetch() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lastFetch
+}
+
+var keyRegex = regexp.MustCompile(`^[a-z0-9._-]+$`)
+
+// mirrorKey returns the path of the mirror of the upstream relative to the mirror directory.
+// Mirrors of different scopes are kept in separate directories named by a hash of the scope.
+func mirrorKey(upstream Upstream) (string, error) {
+	key, err := repositoryKey(upstream.URL)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(upstream.Scope))
+	return hex.EncodeToString(sum[:8]) + "/" + key, nil
+}
+
+// repositoryKey returns the path of the mirror relative to the mirror directory.
+func repositoryKey(rawURL string) (string, error) {
+	trimmed := strings.TrimSuffix(rawURL, ".git")
+	comps := strings.Split(trimmed, "/")
+	if len(comps) < 3 {
+		return "", fmt.Errorf("invalid repository url %s", rawURL)
+	}
+	host, owner, name := comps[len(comps)-3], comps[len(comps)-2], comps[len(comps)-1]
+	key := []string{}
+	for _, comp := range []string{host, owner, name} {
+		comp = strings.ToLower(comp)
+		if comp == "." || comp == ".." || !keyRegex.MatchString(strings.ReplaceAll(comp, ":", "_")) {
+			return "", fmt.Errorf("invalid repository url %s", rawURL)
+		}
+		key = append(key, strings.ReplaceAll(comp, ":", "_"))
+	}
+	return strings.Join(key, "/") + ".git", nil
+}
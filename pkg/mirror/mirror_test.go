@@ -0,0 +1,175 @@
+package mirror
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func runGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+// newUpstreamRepository creates a bare repository with a single commit and returns its path.
+func newUpstreamRepository(t *testing.T) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	work := filepath.Join(dir, "work")
+	upstream := filepath.Join(dir, "example.com", "org", "repo.git")
+	require.NoError(t, os.MkdirAll(work, 0o750))
+	runGit(t, dir, "init", "--quiet", "--bare", "-b", "main", upstream)
+	runGit(t, work, "init", "--quiet", "-b", "main")
+	require.NoError(t, os.WriteFile(filepath.Join(work, "README.md"), []byte("first"), 0o600))
+	runGit(t, work, "add", "README.md")
+	runGit(t, work, "commit", "--quiet", "-m", "first")
+	runGit(t, work, "push", "--quiet", upstream, "main")
+	return upstream, work
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		target string
+		owner  string
+		repo   string
+		ok     bool
+	}{
+		{
+			name:   "advertise refs",
+			method: http.MethodGet,
+			target: "/org/repo.git/info/refs?service=git-upload-pack",
+			owner:  "org",
+			repo:   "repo",
+			ok:     true,
+		},
+		{
+			name:   "upload pack without suffix",
+			method: http.MethodPost,
+			target: "/org/repo/git-upload-pack",
+			owner:  "org",
+			repo:   "repo",
+			ok:     true,
+		},
+		{
+			name:   "receive pack advertisement",
+			method: http.MethodGet,
+			target: "/org/repo.git/info/refs?service=git-receive-pack",
+			ok:     false,
+		},
+		{
+			name:   "receive pack",
+			method: http.MethodPost,
+			target: "/org/repo.git/git-receive-pack",
+			ok:     false,
+		},
+		{
+			name:   "api",
+			method: http.MethodGet,
+			target: "/api/v3/repos/org/repo",
+			ok:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			owner, repo, ok := ParsePath(req)
+			require.Equal(t, tt.ok, ok)
+			require.Equal(t, tt.owner, owner)
+			require.Equal(t, tt.repo, repo)
+		})
+	}
+}
+
+func TestRepositoryKey(t *testing.T) {
+	key, err := repositoryKey("https://GitHub.com/Org/Repo.git")
+	require.NoError(t, err)
+	require.Equal(t, "github.com/org/repo.git", key)
+	key, err = repositoryKey("https://ghes.example.com:8443/org/repo")
+	require.NoError(t, err)
+	require.Equal(t, "ghes.example.com_8443/org/repo.git", key)
+	_, err = repositoryKey("https://github.com/org/..")
+	require.Error(t, err)
+}
+
+func TestMirrorKey(t *testing.T) {
+	first, err := mirrorKey(Upstream{Scope: "github.com//first", URL: "https://github.com/org/repo.git"})
+	require.NoError(t, err)
+	require.Regexp(t, `^[0-9a-f]{16}/github.com/org/repo.git$`, first)
+	second, err := mirrorKey(Upstream{Scope: "github.com//second", URL: "https://github.com/org/repo.git"})
+	require.NoError(t, err)
+	require.NotEqual(t, first, second)
+	again, err := mirrorKey(Upstream{Scope: "github.com//first", URL: "https://github.com/Org/Repo"})
+	require.NoError(t, err)
+	require.Equal(t, first, again)
+}
+
+// newMirrorServer serves upload-pack requests from the cache.
+func newMirrorServer(t *testing.T, cache *Cache, upstream string) string {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := ParsePath(r); !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if err := cache.Serve(w, r, Upstream{URL: upstream}); err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestServe(t *testing.T) {
+	upstream, work := newUpstreamRepository(t)
+	dir := t.TempDir()
+	cache, err := NewCache(Config{
+		Dir:          dir,
+		TTL:          time.Hour,
+		FetchTimeout: time.Minute,
+	})
+	require.NoError(t, err)
+	srvURL := newMirrorServer(t, cache, upstream)
+
+	clone := filepath.Join(t.TempDir(), "clone")
+	runGit(t, t.TempDir(), "clone", "--quiet", srvURL+"/org/repo.git", clone)
+	b, err := os.ReadFile(filepath.Join(clone, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "first", string(b))
+
+	// The mirror is not fetched again until the TTL has passed.
+	require.NoError(t, os.WriteFile(filepath.Join(work, "README.md"), []byte("second"), 0o600))
+	runGit(t, work, "commit", "--quiet", "-am", "second")
+	runGit(t, work, "push", "--quiet", upstream, "main")
+	runGit(t, clone, "pull", "--quiet")
+	b, err = os.ReadFile(filepath.Join(clone, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "first", string(b))
+
+	// A cache without TTL on the same directory fetches the existing mirror before every advertisement.
+	expiredCache, err := NewCache(Config{
+		Dir:          dir,
+		TTL:          0,
+		FetchTimeout: time.Minute,
+	})
+	require.NoError(t, err)
+	expiredURL := newMirrorServer(t, expiredCache, upstream)
+	runGit(t, clone, "pull", "--quiet", expiredURL+"/org/repo.git", "main")
+	b, err = os.ReadFile(filepath.Join(clone, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "second", string(b))
+}
@@ -0,0 +1,191 @@
+// Package policytest evaluates test cases of the expected authorization decisions against the policies of a configuration.
+package policytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+)
+
+const (
+	ExpectAllow = "allow"
+	ExpectDeny  = "deny"
+)
+
+// Case is the expected authorization decision of a single request. The request is made either with
+// a client token, which is checked against all policies unless the policy is set, or as the policy.
+type Case struct {
+	Name   string `json:"name" yaml:"name" validate:"required"`
+	Token  string `json:"token,omitempty" yaml:"token,omitempty" validate:"required_without=Policy"`
+	Policy string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	Method string `json:"method" yaml:"method" validate:"required"`
+	Path   string `json:"path" yaml:"path" validate:"required,startswith=/"`
+	Expect string `json:"expect" yaml:"expect" validate:"required,oneof=allow deny"`
+}
+
+// Suite is a file of test cases.
+type Suite struct {
+	Name  string `json:"-" yaml:"-"`
+	Cases []Case `json:"cases" yaml:"cases" validate:"required,dive"`
+}
+
+// Result is the outcome of a test case. Err is set if the case could not be evaluated.
+type Result struct {
+	Case     Case
+	Passed   bool
+	Message  string
+	Err      error
+	Duration time.Duration
+}
+
+// LoadSuite parses and validates a file of test cases, files with a .yaml or .yml extension are parsed as YAML and all other files as JSON.
+func LoadSuite(fs afero.Fs, path string) (*Suite, error) {
+	b, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	suite := &Suite{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(suite)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(suite)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if err := validator.New().Struct(suite); err != nil {
+		return nil, fmt.Errorf("invalid test cases in %s: %w", path, err)
+	}
+	suite.Name = path
+	return suite, nil
+}
+
+// Run evaluates the test cases of the suite. Policies in audit mode are evaluated as if they were enforced.
+func Run(authz *auth.Authorizer, suite *Suite) []Result {
+	results := []Result{}
+	for _, c := range suite.Cases {
+		start := time.Now()
+		result := evaluate(authz, c)
+		result.Duration = time.Since(start)
+		results = append(results, result)
+	}
+	return results
+}
+
+func evaluate(authz *auth.Authorizer, c Case) Result {
+	method := strings.ToUpper(c.Method)
+	var endpoints []*auth.Endpoint
+	if c.Token != "" {
+		var err error
+		endpoints, err = authz.GetEndpointsByIdentity(auth.Identity{Token: c.Token, PolicyID: c.Policy})
+		if err != nil && !errors.Is(err, auth.ErrNotAuthenticated) {
+			return Result{Case: c, Err: err}
+		}
+	} else {
+		endpoints = authz.GetEndpointsByPolicyID(c.Policy)
+		if len(endpoints) == 0 {
+			return Result{Case: c, Err: fmt.Errorf("policy %s not found", c.Policy)}
+		}
+	}
+	// The query is not part of the authorization, like for requests to the proxy
+	u, err := url.Parse(c.Path)
+	if err != nil {
+		return Result{Case: c, Err: fmt.Errorf("invalid path: %w", err)}
+	}
+	explanation := auth.Explain(endpoints, method, u.EscapedPath())
+	actual := ExpectDeny
+	message := fmt.Sprintf("%s %s is denied", method, c.Path)
+	if explanation.Endpoint != nil && !explanation.Audit {
+		actual = ExpectAllow
+		message = fmt.Sprintf("%s %s is allowed by policy %s", method, c.Path, explanation.Endpoint.ID())
+	}
+	return Result{
+		Case:    c,
+		Passed:  actual == c.Expect,
+		Message: message,
+	}
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Error     *junitMessage `xml:"error,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+}
+
+// WriteJUnit writes the results of the suites as a JUnit XML report. The results have to be in the order of the suites.
+func WriteJUnit(w io.Writer, suites []*Suite, results [][]Result) error {
+	report := junitTestSuites{}
+	for i, suite := range suites {
+		ts := junitTestSuite{Name: suite.Name}
+		var total time.Duration
+		for _, r := range results[i] {
+			tc := junitTestCase{Name: r.Case.Name, ClassName: suite.Name, Time: seconds(r.Duration)}
+			switch {
+			case r.Err != nil:
+				ts.Errors++
+				tc.Error = &junitMessage{Message: r.Err.Error(), Type: "error"}
+			case !r.Passed:
+				ts.Failures++
+				tc.Failure = &junitMessage{Message: fmt.Sprintf("expected %s: %s", r.Case.Expect, r.Message), Type: "failure"}
+			}
+			total += r.Duration
+			ts.Tests++
+			ts.Cases = append(ts.Cases, tc)
+		}
+		ts.Time = seconds(total)
+		report.Suites = append(report.Suites, ts)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
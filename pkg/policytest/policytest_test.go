@@ -0,0 +1,171 @@
+package policytest
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+const yamlSuite = `
+cases:
+  - name: clone
+    token: incoming-test-token
+    method: GET
+    path: /org/repo.git/info/refs?service=git-upload-pack
+    expect: allow
+  - name: push
+    policy: dev
+    method: POST
+    path: /org/repo.git/git-receive-pack
+    expect: allow
+  - name: other repository
+    policy: dev
+    method: GET
+    path: /org/other.git/info/refs
+    expect: allow
+  - name: invalid token
+    token: invalid-token
+    method: GET
+    path: /org/repo.git/info/refs
+    expect: deny
+  - name: missing policy
+    policy: prod
+    method: GET
+    path: /org/repo.git/info/refs
+    expect: deny
+`
+
+const jsonSuite = `
+{
+  "cases": [
+    {
+      "name": "clone",
+      "policy": "dev",
+      "method": "GET",
+      "path": "/org/repo.git/info/refs",
+      "expect": "allow"
+    }
+  ]
+}
+`
+
+func getAuthorizer(t *testing.T) *auth.Authorizer {
+	t.Helper()
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:           "dev",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+				UserAuth: config.UserAuth{
+					// mkpasswd -m sha512crypt incoming-test-token
+					TokenHash: "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou.",
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	return authz
+}
+
+func TestRun(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, "cases.yaml", []byte(yamlSuite), 0o600))
+	suite, err := LoadSuite(fs, "cases.yaml")
+	require.NoError(t, err)
+	require.Equal(t, "cases.yaml", suite.Name)
+	require.Len(t, suite.Cases, 5)
+
+	results := Run(getAuthorizer(t), suite)
+	require.Len(t, results, 5)
+	require.True(t, results[0].Passed)
+	require.Equal(t, "GET /org/repo.git/info/refs?service=git-upload-pack is allowed by policy github.com//dev", results[0].Message)
+	require.True(t, results[1].Passed)
+	require.False(t, results[2].Passed)
+	require.NoError(t, results[2].Err)
+	require.Equal(t, "GET /org/other.git/info/refs is denied", results[2].Message)
+	require.True(t, results[3].Passed)
+	require.False(t, results[4].Passed)
+	require.EqualError(t, results[4].Err, "policy prod not found")
+}
+
+func TestLoadSuite(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		content  string
+		expected string
+	}{
+		{
+			name:    "json",
+			path:    "cases.json",
+			content: jsonSuite,
+		},
+		{
+			name:     "unknown field",
+			path:     "cases.yaml",
+			content:  "cases:\n  - name: clone\n    policy: dev\n    method: GET\n    path: /org/repo\n    expect: allow\n    host: github.com\n",
+			expected: "could not parse cases.yaml: yaml: unmarshal errors:\n  line 7: field host not found in type policytest.Case",
+		},
+		{
+			name:     "invalid expectation",
+			path:     "cases.yaml",
+			content:  "cases:\n  - name: clone\n    policy: dev\n    method: GET\n    path: /org/repo\n    expect: permit\n",
+			expected: "invalid test cases in cases.yaml: Key: 'Suite.Cases[0].Expect' Error:Field validation for 'Expect' failed on the 'oneof' tag",
+		},
+		{
+			name:     "missing identity",
+			path:     "cases.json",
+			content:  `{"cases": [{"name": "clone", "method": "GET", "path": "/org/repo", "expect": "allow"}]}`,
+			expected: "invalid test cases in cases.json: Key: 'Suite.Cases[0].Token' Error:Field validation for 'Token' failed on the 'required_without' tag",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := afero.NewMemMapFs()
+			require.NoError(t, afero.WriteFile(fs, tt.path, []byte(tt.content), 0o600))
+			_, err := LoadSuite(fs, tt.path)
+			if tt.expected == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.expected)
+		})
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	suites := []*Suite{{Name: "cases.yaml"}}
+	results := [][]Result{
+		{
+			{Case: Case{Name: "clone"}, Passed: true, Duration: 1500 * time.Microsecond},
+			{Case: Case{Name: "push", Expect: ExpectDeny}, Message: "POST /org/repo.git/git-receive-pack is allowed by policy github.com//dev"},
+			{Case: Case{Name: "missing"}, Err: errors.New("policy prod not found")},
+		},
+	}
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteJUnit(buf, suites, results))
+	expected := `<?xml version="1.0" encoding="UTF-8"?>
+<testsuites>
+  <testsuite name="cases.yaml" tests="3" failures="1" errors="1" time="0.002">
+    <testcase name="clone" classname="cases.yaml" time="0.002"></testcase>
+    <testcase name="push" classname="cases.yaml" time="0.000">
+      <failure message="expected deny: POST /org/repo.git/git-receive-pack is allowed by policy github.com//dev" type="failure"></failure>
+    </testcase>
+    <testcase name="missing" classname="cases.yaml" time="0.000">
+      <error message="policy prod not found" type="error"></error>
+    </testcase>
+  </testsuite>
+</testsuites>
+`
+	require.Equal(t, expected, buf.String())
+}
@@ -0,0 +1,106 @@
+// Package redact masks credentials in log output.
+package redact
+
+import (
+	b64 "encoding/base64"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// Redacted replaces masked values.
+const Redacted = "[REDACTED]"
+
+var (
+	// authorizationPattern matches the value of authorization headers, keeping the scheme.
+	authorizationPattern = regexp.MustCompile(`(?i)((?:proxy-)?authorization["']?\s*[:=]\s*\[?["']?)((?:basic|bearer|token)\s+)?[^\s"'\],}]+`)
+	// userinfoPattern matches the credentials of URLs.
+	userinfoPattern = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/\s@"']+@`)
+	// queryTokenPattern matches query parameters which carry credentials.
+	queryTokenPattern = regexp.MustCompile(`(?i)([?&](?:access_token|token|private_token|client_secret|password|jwt|sig|signature|x-amz-signature|x-amz-credential|x-amz-security-token)=)[^&\s"']+`)
+)
+
+// SecretForms returns the forms an upstream token appears in, the token itself and the encodings used for Basic upstream authorization.
+func SecretForms(token string) []string {
+	return []string{
+		b64.StdEncoding.EncodeToString([]byte("x-access-token:" + token)),
+		b64.URLEncoding.EncodeToString([]byte("x-access-token:" + token)),
+		token,
+	}
+}
+
+// Redactor masks credentials in strings. Secrets can be added after the redactor is in use,
+// so that the logger can be created before the configuration with the secrets is loaded.
+type Redactor struct {
+	secrets atomic.Pointer[strings.Replacer]
+	values  atomic.Pointer[[]string]
+}
+
+func NewRedactor() *Redactor {
+	return &Redactor{}
+}
+
+// AddSecrets masks the values and their encoded forms wherever they appear.
+func (r *Redactor) AddSecrets(values ...string) {
+	for {
+		old := r.values.Load()
+		secrets := []string{}
+		if old != nil {
+			secrets = append(secrets, *old...)
+		}
+		for _, v := range values {
+			if v != "" {
+				secrets = append(secrets, SecretForms(v)...)
+			}
+		}
+		if !r.values.CompareAndSwap(old, &secrets) {
+			continue
+		}
+		oldnew := make([]string, 0, len(secrets)*2)
+		for _, s := range secrets {
+			oldnew = append(oldnew, s, Redacted)
+		}
+		r.secrets.Store(strings.NewReplacer(oldnew...))
+		return
+	}
+}
+
+// String returns the string with authorization header values, URL credentials, query tokens and secrets masked.
+func (r *Redactor) String(s string) string {
+	if secrets := r.secrets.Load(); secrets != nil {
+		s = secrets.Replace(s)
+	}
+	s = authorizationPattern.ReplaceAllString(s, "${1}${2}"+Redacted)
+	s = userinfoPattern.ReplaceAllString(s, "${1}"+Redacted+"@")
+	return queryTokenPattern.ReplaceAllString(s, "${1}"+Redacted)
+}
+
+// encoder masks credentials in the encoded log entries of the wrapped encoder.
+type encoder struct {
+	zapcore.Encoder
+	redactor *Redactor
+}
+
+// NewEncoder returns an encoder which redacts the entries encoded by enc. Redaction is applied
+// to the encoded output, so that messages, fields, errors and the logger context are all covered.
+func NewEncoder(enc zapcore.Encoder, r *Redactor) zapcore.Encoder {
+	return &encoder{Encoder: enc, redactor: r}
+}
+
+func (e *encoder) Clone() zapcore.Encoder {
+	return &encoder{Encoder: e.Encoder.Clone(), redactor: e.redactor}
+}
+
+func (e *encoder) EncodeEntry(entry zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	buf, err := e.Encoder.EncodeEntry(entry, fields)
+	if err != nil {
+		return nil, err
+	}
+	redacted := e.redactor.String(buf.String())
+	buf.Reset()
+	buf.AppendString(redacted)
+	return buf, nil
+}
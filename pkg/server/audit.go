@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/legobeat/git-auth-proxy/pkg/audit"
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+)
+
+const (
+	decisionError = "error"
+
+	reasonLockedOut          = "locked_out"
+	reasonInvalidCredentials = "invalid_credentials"
+	reasonNotAuthenticated   = "not_authenticated"
+	reasonNotPermitted       = "not_permitted"
+	reasonUpstreamAuth       = "upstream_authentication"
+	reasonMirror             = "mirror"
+	reasonRepositoryList     = "repository_list"
+
+	serviceAPI      = "api"
+	serviceGraphQL  = "graphql"
+	serviceDownload = "download"
+	serviceGit      = "git"
+)
+
+// newAuditEvent returns the audit event of the request, which is completed by the proxy handler.
+func newAuditEvent(c *gin.Context, creds *Credentials) *audit.Event {
+	service, repository := describeRequest(c.Request)
+	event := &audit.Event{
+		Type:       audit.TypeRequest,
+		ClientIP:   c.ClientIP(),
+		Method:     c.Request.Method,
+		Path:       c.Request.URL.Path,
+		Service:    service,
+		Repository: repository,
+	}
+	// The username is only recorded when it is the policy ID, as clients may send their token as the username
+	if creds != nil {
+		event.Username = creds.PolicyID
+	}
+	return event
+}
+
+// newLockoutEvent returns the audit event of a client being locked out by the key.
+func newLockoutEvent(c *gin.Context, key lockoutKey, d time.Duration) *audit.Event {
+	event := &audit.Event{
+		Type:      audit.TypeLockout,
+		ClientIP:  c.ClientIP(),
+		Reason:    "failed_authentication_attempts_by_" + key.kind,
+		LockedFor: d.String(),
+	}
+	if key.kind == lockoutKeyUsername {
+		event.Username = key.value
+	}
+	return event
+}
+
+// describeRequest returns the service and the repository the request is for, the repository is empty if the request is not repository specific.
+func describeRequest(req *http.Request) (string, string) {
+	path := req.URL.Path
+	switch {
+	case strings.HasPrefix(path, auth.DownloadPathPrefix):
+		return serviceDownload, ""
+	case strings.HasPrefix(path, "/graphql") || strings.HasPrefix(path, "/api/graphql"):
+		return serviceGraphQL, ""
+	case isAPIPath(path):
+		comps := strings.Split(strings.TrimPrefix(path, "/api/v3"), "/")
+		if len(comps) > 3 && comps[1] == "repos" {
+			return serviceAPI, comps[2] + "/" + comps[3]
+		}
+		return serviceAPI, ""
+	}
+	comps := strings.Split(path, "/")
+	if len(comps) < 3 || comps[1] == "" || comps[2] == "" {
+		return serviceGit, ""
+	}
+	repository := comps[1] + "/" + strings.TrimSuffix(comps[2], ".git")
+	switch last := comps[len(comps)-1]; {
+	case last == "refs" && comps[len(comps)-2] == "info" && req.URL.Query().Get("service") != "":
+		return req.URL.Query().Get("service"), repository
+	case strings.HasPrefix(last, "git-"):
+		return last, repository
+	default:
+		return serviceGit, repository
+	}
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/audit"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestDescribeRequest(t *testing.T) {
+	tests := []struct {
+		method     string
+		url        string
+		service    string
+		repository string
+	}{
+		{method: http.MethodGet, url: "/org/repo.git/info/refs?service=git-upload-pack", service: "git-upload-pack", repository: "org/repo"},
+		{method: http.MethodPost, url: "/org/repo/git-receive-pack", service: "git-receive-pack", repository: "org/repo"},
+		{method: http.MethodGet, url: "/org/repo/info/refs", service: serviceGit, repository: "org/repo"},
+		{method: http.MethodGet, url: "/api/v3/repos/org/repo/pulls", service: serviceAPI, repository: "org/repo"},
+		{method: http.MethodGet, url: "/api/v3/orgs/org/teams", service: serviceAPI},
+		{method: http.MethodPost, url: "/api/graphql", service: serviceGraphQL},
+		{method: http.MethodGet, url: "/_download/codeload.github.com/org/repo/legacy.tar.gz/main", service: serviceDownload},
+		{method: http.MethodGet, url: "/", service: serviceGit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.url, nil)
+			require.NoError(t, err)
+			service, repository := describeRequest(req)
+			require.Equal(t, tt.service, service)
+			require.Equal(t, tt.repository, repository)
+		})
+	}
+}
+
+// syncBuffer is a buffer which can be written by the proxy while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte{}, b.buf.Bytes()...)
+}
+
+func TestProxyHandlerAudit(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	buf := &syncBuffer{}
+	proxyURL := newTestProxy(t, upstream, func(_ *config.Configuration, cfg *Config) {
+		cfg.Audit = audit.NewLogger(buf)
+	})
+
+	for _, path := range []string{"/org/repo.git/info/refs?service=git-upload-pack", "/org/other.git/info/refs?service=git-upload-pack"} {
+		req, err := http.NewRequest(http.MethodGet, proxyURL+path, nil)
+		require.NoError(t, err)
+		req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	// Events are written after the response has been sent
+	require.Eventually(t, func() bool {
+		return bytes.Count(buf.Bytes(), []byte("\n")) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	events := []audit.Event{}
+	dec := json.NewDecoder(bytes.NewReader(buf.Bytes()))
+	for dec.More() {
+		event := audit.Event{}
+		require.NoError(t, dec.Decode(&event))
+		require.False(t, event.Time.IsZero())
+		events = append(events, event)
+	}
+	require.Len(t, events, 2)
+	require.Equal(t, audit.Event{
+		Time:           events[0].Time,
+		Type:           audit.TypeRequest,
+		ClientIP:       "127.0.0.1",
+		Auth:           authToken,
+		Policy:         events[0].Policy,
+		Credential:     "test/0",
+		Method:         http.MethodGet,
+		Path:           "/org/repo.git/info/refs",
+		Service:        "git-upload-pack",
+		Repository:     "org/repo",
+		Decision:       decisionAllowed,
+		UpstreamStatus: http.StatusOK,
+	}, events[0])
+	require.Contains(t, events[0].Policy, "//test")
+	require.Equal(t, decisionDenied, events[1].Decision)
+	require.Equal(t, reasonNotPermitted, events[1].Reason)
+	require.Equal(t, "org/other", events[1].Repository)
+	require.Empty(t, events[1].Policy)
+	require.Empty(t, events[1].UpstreamStatus)
+}
+
+func TestProxyHandlerAuditMode(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	buf := &syncBuffer{}
+	proxyURL := newTestProxy(t, upstream, func(appCfg *config.Configuration, cfg *Config) {
+		appCfg.Policies[0].Mode = config.PolicyModeAudit
+		cfg.Audit = audit.NewLogger(buf)
+	})
+
+	req, err := http.NewRequest(http.MethodGet, proxyURL+"/org/other.git/info/refs?service=git-upload-pack", nil)
+	require.NoError(t, err)
+	req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	require.Eventually(t, func() bool {
+		return bytes.Count(buf.Bytes(), []byte("\n")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	event := audit.Event{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+	require.Equal(t, decisionAuditDenied, event.Decision)
+	require.Equal(t, reasonNotPermitted, event.Reason)
+	require.Equal(t, "org/other", event.Repository)
+	require.Contains(t, event.Policy, "//test")
+	require.Equal(t, http.StatusOK, event.UpstreamStatus)
+}
+
+func TestProxyHandlerAuditUsername(t *testing.T) {
+	tests := []struct {
+		name               string
+		authorization      string
+		usernameAsPolicyID bool
+		expectedUsername   string
+	}{
+		{
+			name:          "token as username",
+			authorization: basicAuth("incoming-test-token", "x-oauth-basic"),
+		},
+		{
+			name:          "invalid token as username",
+			authorization: basicAuth("invalid-token", "x-oauth-basic"),
+		},
+		{
+			name:               "username as policy id",
+			authorization:      basicAuth("test", "incoming-test-token"),
+			usernameAsPolicyID: true,
+			expectedUsername:   "test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}
+			buf := &syncBuffer{}
+			proxyURL := newTestProxy(t, upstream, func(_ *config.Configuration, cfg *Config) {
+				cfg.Audit = audit.NewLogger(buf)
+				cfg.UsernameAsPolicyID = tt.usernameAsPolicyID
+			})
+			req, err := http.NewRequest(http.MethodGet, proxyURL+"/org/repo.git/info/refs?service=git-upload-pack", nil)
+			require.NoError(t, err)
+			req.Header.Set(headerKey, tt.authorization)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+
+			require.Eventually(t, func() bool {
+				return bytes.Count(buf.Bytes(), []byte("\n")) == 1
+			}, 5*time.Second, 10*time.Millisecond)
+			require.NotContains(t, string(buf.Bytes()), "-token")
+			event := audit.Event{}
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &event))
+			require.Equal(t, tt.expectedUsername, event.Username)
+		})
+	}
+}
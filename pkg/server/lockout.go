@@ -0,0 +1,194 @@
+package server
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	lockoutKeyIP       = "ip"
+	lockoutKeyUsername = "username"
+)
+
+var (
+	authFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_auth_failures_total",
+		Help: "Total number of failed authentication attempts by key type.",
+	}, []string{"key"})
+	authLockoutsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_auth_lockouts_total",
+		Help: "Total number of times a client was locked out by key type.",
+	}, []string{"key"})
+	authLockedRequestsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "git_auth_proxy_auth_locked_requests_total",
+		Help: "Total number of requests rejected because the client was locked out.",
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "git_auth_proxy_auth_locked_clients",
+		Help: "Number of client IPs and usernames currently tracked as locked out.",
+	}, func() float64 {
+		if f := activeFailureTracker.Load(); f != nil {
+			return float64(f.lockedClients())
+		}
+		return 0
+	})
+
+	// activeFailureTracker is the tracker reported by the locked clients gauge, which is the latest one created
+	// as the proxy creates a single tracker.
+	activeFailureTracker atomic.Pointer[failureTracker]
+)
+
+// LockoutConfig configures the backoff applied to clients after failed authentication attempts.
+type LockoutConfig struct {
+	// Threshold is the number of failures after which a client is locked out, zero disables lockouts.
+	Threshold int
+	// BaseDelay is the duration of the first lockout, it is doubled for every further failure.
+	BaseDelay time.Duration
+	// MaxDelay is the upper bound of the lockout duration.
+	MaxDelay time.Duration
+	// Window is the duration after which failures are forgotten.
+	Window time.Duration
+	// ByIP tracks failures per client IP. It should only be enabled if the client IP can be determined,
+	// clients behind a proxy which is not trusted share its IP and would be locked out together.
+	ByIP bool
+}
+
+type lockoutKey struct {
+	kind  string
+	value string
+}
+
+type failureEntry struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// failureTracker counts failed authentication attempts per client IP and username.
+type failureTracker struct {
+	cfg LockoutConfig
+	now func() time.Time
+
+	mu        sync.Mutex
+	entries   map[lockoutKey]*failureEntry
+	lastSweep time.Time
+}
+
+func newFailureTracker(cfg LockoutConfig) *failureTracker {
+	f := &failureTracker{
+		cfg:     cfg,
+		now:     time.Now,
+		entries: map[lockoutKey]*failureEntry{},
+	}
+	activeFailureTracker.Store(f)
+	return f
+}
+
+func (f *failureTracker) enabled() bool {
+	return f.cfg.Threshold > 0
+}
+
+// lockedFor returns the remaining lockout duration of the most restricted key.
+func (f *failureTracker) lockedFor(keys ...lockoutKey) time.Duration {
+	if !f.enabled() {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	remaining := time.Duration(0)
+	for _, key := range keys {
+		entry, ok := f.entries[key]
+		if !ok {
+			continue
+		}
+		if d := entry.lockedUntil.Sub(now); d > remaining {
+			remaining = d
+		}
+	}
+	return remaining
+}
+
+// failure records a failed attempt for all keys and returns the keys which have been locked out by it.
+func (f *failureTracker) failure(keys ...lockoutKey) map[lockoutKey]time.Duration {
+	locked := map[lockoutKey]time.Duration{}
+	if !f.enabled() {
+		return locked
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	f.sweep(now)
+	for _, key := range keys {
+		authFailuresTotal.WithLabelValues(key.kind).Inc()
+		entry, ok := f.entries[key]
+		if !ok || now.Sub(entry.lastFailure) > f.cfg.Window {
+			entry = &failureEntry{}
+			f.entries[key] = entry
+		}
+		entry.failures++
+		entry.lastFailure = now
+		if entry.failures < f.cfg.Threshold {
+			continue
+		}
+		d := f.delay(entry.failures)
+		entry.lockedUntil = now.Add(d)
+		locked[key] = d
+		authLockoutsTotal.WithLabelValues(key.kind).Inc()
+	}
+	return locked
+}
+
+// success forgets the failures of the given keys.
+func (f *failureTracker) success(keys ...lockoutKey) {
+	if !f.enabled() || len(keys) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, key := range keys {
+		delete(f.entries, key)
+	}
+}
+
+// delay doubles the base delay for every failure past the threshold.
+func (f *failureTracker) delay(failures int) time.Duration {
+	exp := float64(failures - f.cfg.Threshold)
+	d := float64(f.cfg.BaseDelay) * math.Pow(2, exp)
+	if d > float64(f.cfg.MaxDelay) {
+		return f.cfg.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+// sweep removes expired entries, it runs at most once per window.
+func (f *failureTracker) sweep(now time.Time) {
+	if now.Sub(f.lastSweep) < f.cfg.Window {
+		return
+	}
+	f.lastSweep = now
+	for key, entry := range f.entries {
+		if now.Sub(entry.lastFailure) > f.cfg.Window && now.After(entry.lockedUntil) {
+			delete(f.entries, key)
+		}
+	}
+}
+
+// lockedClients returns the number of keys which are currently locked out, it is called when metrics are collected.
+func (f *failureTracker) lockedClients() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	count := 0
+	for _, entry := range f.entries {
+		if entry.lockedUntil.After(now) {
+			count++
+		}
+	}
+	return count
+}
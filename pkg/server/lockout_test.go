@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailureTracker(t *testing.T) {
+	now := time.Now()
+	f := newFailureTracker(LockoutConfig{
+		Threshold: 3,
+		BaseDelay: time.Second,
+		MaxDelay:  5 * time.Second,
+		Window:    time.Minute,
+	})
+	f.now = func() time.Time { return now }
+	ip := lockoutKey{kind: lockoutKeyIP, value: "192.0.2.1"}
+	username := lockoutKey{kind: lockoutKeyUsername, value: "flux"}
+
+	for i := 0; i < 2; i++ {
+		require.Empty(t, f.failure(ip, username))
+		require.Zero(t, f.lockedFor(ip))
+	}
+	locked := f.failure(ip, username)
+	require.Equal(t, map[lockoutKey]time.Duration{ip: time.Second, username: time.Second}, locked)
+	require.Equal(t, time.Second, f.lockedFor(ip))
+	require.Equal(t, time.Second, f.lockedFor(lockoutKey{kind: lockoutKeyIP, value: "192.0.2.2"}, username))
+	require.Equal(t, 2, f.lockedClients())
+
+	// The lockout doubles for every further failure up to the maximum.
+	require.Equal(t, 2*time.Second, f.failure(ip)[ip])
+	require.Equal(t, 4*time.Second, f.failure(ip)[ip])
+	require.Equal(t, 5*time.Second, f.failure(ip)[ip])
+
+	now = now.Add(6 * time.Second)
+	require.Zero(t, f.lockedFor(ip))
+
+	// Success only resets the given keys.
+	f.success(username)
+	require.Zero(t, f.lockedFor(username))
+	require.Equal(t, 5*time.Second, f.failure(ip)[ip])
+
+	// Failures are forgotten after the window.
+	now = now.Add(2 * time.Minute)
+	require.Empty(t, f.failure(ip))
+}
+
+func TestFailureTrackerDisabled(t *testing.T) {
+	f := newFailureTracker(LockoutConfig{})
+	ip := lockoutKey{kind: lockoutKeyIP, value: "192.0.2.1"}
+	for i := 0; i < 100; i++ {
+		require.Empty(t, f.failure(ip))
+	}
+	require.Zero(t, f.lockedFor(ip))
+}
+
+func TestLockoutKeys(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/org/repo/info/refs", nil)
+	c.Request.RemoteAddr = "192.0.2.1:1234"
+	ip := lockoutKey{kind: lockoutKeyIP, value: "192.0.2.1"}
+
+	// Shared usernames must not lock out other clients.
+	require.Equal(t, []lockoutKey{ip}, lockoutKeys(c, nil, true))
+	require.Equal(t, []lockoutKey{ip}, lockoutKeys(c, &Credentials{Username: "git", Token: "token"}, true))
+	username := lockoutKey{kind: lockoutKeyUsername, value: "dev"}
+	require.Equal(t, []lockoutKey{ip, username}, lockoutKeys(c, &Credentials{Username: "dev", Token: "token", PolicyID: "dev"}, true))
+	// Client IPs are only tracked if enabled.
+	require.Empty(t, lockoutKeys(c, &Credentials{Username: "git", Token: "token"}, false))
+	require.Equal(t, []lockoutKey{username}, lockoutKeys(c, &Credentials{Username: "dev", Token: "token", PolicyID: "dev"}, false))
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+
+	"github.com/legobeat/git-auth-proxy/pkg/audit"
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+)
+
+const (
+	authNone        = "none"
+	authAnonymous   = "anonymous"
+	authToken       = "token"
+	authCertificate = "certificate"
+
+	decisionAllowed = "allowed"
+	decisionDenied  = "denied"
+	// decisionAuditDenied is a request proxied by a policy in audit mode which it would otherwise deny.
+	decisionAuditDenied = "audit_denied"
+
+	directionUpload   = "upload"
+	directionDownload = "download"
+
+	// repositoryOther is the repository label of repositories which are not listed explicitly in the policy.
+	repositoryOther = "other"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_requests_total",
+		Help: "Total number of proxy requests by policy, authentication method and authorization decision.",
+	}, []string{"policy", "auth", "decision"})
+	repositoryRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_repository_requests_total",
+		Help: "Total number of proxy requests by policy, repository, service and decision.",
+	}, []string{"policy", "repository", "service", "decision"})
+	transferredBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_auth_proxy_transferred_bytes_total",
+		Help: "Total number of body bytes uploaded by clients and downloaded to clients by policy and repository.",
+	}, []string{"policy", "repository", "direction"})
+	upstreamRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "git_auth_proxy_upstream_request_duration_seconds",
+		Help:    "Time until the upstream responded with headers by policy and service.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"policy", "service"})
+)
+
+// authMethod returns how the identity was matched to the endpoint, or which credentials
+// were presented if the endpoint is nil. Endpoints matching the client certificate are
+// evaluated before the endpoints matching the token.
+func authMethod(id auth.Identity, e *auth.Endpoint) string {
+	switch {
+	case e != nil && e.IsAnonymous():
+		return authAnonymous
+	case e != nil && e.MatchesCertificate(id.Certificate):
+		return authCertificate
+	case id.Token != "":
+		return authToken
+	case id.Certificate != nil:
+		return authCertificate
+	case e == nil:
+		return authAnonymous
+	default:
+		return authNone
+	}
+}
+
+// policyLabel returns the bounded policy label for the endpoint.
+func policyLabel(e *auth.Endpoint) string {
+	if e == nil {
+		return authNone
+	}
+	return e.ID()
+}
+
+// recordRequest records the metrics of the request described by the audit event.
+func recordRequest(c *gin.Context, event *audit.Event, e *auth.Endpoint, body *countingReader) {
+	policy := policyLabel(e)
+	repository := repositoryLabel(e, event.Repository)
+	repositoryRequestsTotal.WithLabelValues(policy, repository, serviceLabel(event.Service), event.Decision).Inc()
+	if event.Decision != decisionAllowed && event.Decision != decisionAuditDenied {
+		return
+	}
+	if body != nil {
+		transferredBytesTotal.WithLabelValues(policy, repository, directionUpload).Add(float64(body.n))
+	}
+	if size := c.Writer.Size(); size > 0 {
+		transferredBytesTotal.WithLabelValues(policy, repository, directionDownload).Add(float64(size))
+	}
+}
+
+// repositoryLabel returns the bounded repository label. Only repositories listed explicitly
+// in the policy are used as labels, all other repositories are labeled as other.
+func repositoryLabel(e *auth.Endpoint, repository string) string {
+	if repository == "" {
+		return authNone
+	}
+	owner, name, _ := strings.Cut(repository, "/")
+	if e == nil {
+		return repositoryOther
+	}
+	if label, ok := e.ConfiguredRepository(owner, name); ok {
+		return label
+	}
+	return repositoryOther
+}
+
+// serviceLabel returns the bounded service label, unknown git services are labeled as git.
+func serviceLabel(service string) string {
+	switch service {
+	case serviceAPI, serviceGraphQL, serviceDownload, "git-upload-pack", "git-receive-pack", "git-upload-archive":
+		return service
+	default:
+		return serviceGit
+	}
+}
+
+// countingReader counts the bytes read from the request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+type metricLabelsContextKey struct{}
+
+type metricLabels struct {
+	policy  string
+	service string
+}
+
+func withMetricLabels(ctx context.Context, policy, service string) context.Context {
+	return context.WithValue(ctx, metricLabelsContextKey{}, metricLabels{policy: policy, service: service})
+}
+
+// instrumentedTransport traces upstream requests and observes their latency with the labels of the request context.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, span := startClientSpan(req)
+	defer span.End()
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else {
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	}
+	labels, ok := req.Context().Value(metricLabelsContextKey{}).(metricLabels)
+	if ok {
+		upstreamRequestDuration.WithLabelValues(labels.policy, labels.service).Observe(time.Since(start).Seconds())
+	}
+	return resp, err
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestRepositoryLabel(t *testing.T) {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:       "labels",
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Repositories: []*config.Repository{
+					{Owner: "Org", Name: "Repo"},
+					{Owner: "org", Name: "*"},
+				},
+				UserAuth: config.UserAuth{
+					TokenHash: testTokenHash,
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	e := authz.GetEndpoints()[0]
+
+	require.Equal(t, "Org/Repo", repositoryLabel(e, "org/repo"))
+	require.Equal(t, repositoryOther, repositoryLabel(e, "org/other"))
+	require.Equal(t, repositoryOther, repositoryLabel(nil, "org/repo"))
+	require.Equal(t, authNone, repositoryLabel(e, ""))
+	require.Equal(t, "git-upload-pack", serviceLabel("git-upload-pack"))
+	require.Equal(t, serviceGit, serviceLabel("git-unknown-pack"))
+}
+
+func TestAuthMethod(t *testing.T) {
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:           "certificate",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Repositories: []*config.Repository{{Owner: "org", Name: "repo"}},
+				UserAuth:     config.UserAuth{ClientCert: &config.ClientCert{Subject: "CN=flux"}},
+			},
+			{
+				ID:           "token",
+				Provider:     config.GitHubProviderType,
+				Host:         "github.com",
+				Repositories: []*config.Repository{{Owner: "org", Name: "other"}},
+				UserAuth:     config.UserAuth{TokenHash: testTokenHash},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "flux"}}
+	id := auth.Identity{Token: "incoming-test-token", Certificate: cert}
+
+	// A client presenting both credentials is reported with the credential which selected the endpoint
+	e, err := authz.Authorize(context.Background(), id, http.MethodGet, "/org/repo/info/refs")
+	require.NoError(t, err)
+	require.Equal(t, authCertificate, authMethod(id, e))
+	e, err = authz.Authorize(context.Background(), id, http.MethodGet, "/org/other/info/refs")
+	require.NoError(t, err)
+	require.Equal(t, authToken, authMethod(id, e))
+	require.Equal(t, authToken, authMethod(id, nil))
+	require.Equal(t, authCertificate, authMethod(auth.Identity{Certificate: cert}, nil))
+	require.Equal(t, authAnonymous, authMethod(auth.Identity{}, nil))
+}
+
+func TestProxyHandlerMetrics(t *testing.T) {
+	upstreamHost := atomic.Value{}
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		upstreamHost.Store(r.Host)
+		w.WriteHeader(http.StatusOK)
+		//nolint: errcheck //ignore
+		w.Write([]byte("0008NAK\n"))
+	}
+	proxyURL := newTestProxy(t, upstream, func(cfg *config.Configuration, _ *Config) {
+		cfg.Policies[0].ID = "metrics"
+	})
+	req, err := http.NewRequest(http.MethodPost, proxyURL+"/org/repo.git/git-upload-pack", bytes.NewReader([]byte("0000")))
+	require.NoError(t, err)
+	req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	policy := upstreamHost.Load().(string) + "//metrics"
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(repositoryRequestsTotal.WithLabelValues(policy, "org/repo", "git-upload-pack", decisionAllowed)) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, float64(4), testutil.ToFloat64(transferredBytesTotal.WithLabelValues(policy, "org/repo", directionUpload)))
+	require.Equal(t, float64(8), testutil.ToFloat64(transferredBytesTotal.WithLabelValues(policy, "org/repo", directionDownload)))
+	histogram := &dto.Metric{}
+	//nolint: forcetypeassert //the vector only contains histograms
+	require.NoError(t, upstreamRequestDuration.WithLabelValues(policy, "git-upload-pack").(prometheus.Histogram).Write(histogram))
+	require.Equal(t, uint64(1), histogram.GetHistogram().GetSampleCount())
+}
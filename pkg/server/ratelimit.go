@@ -0,0 +1,75 @@
+package server
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+)
+
+const (
+	throttleReasonRate        = "rate"
+	throttleReasonConcurrency = "concurrency"
+
+	// concurrencyRetryAfter is the retry hint given when the concurrency limit is reached,
+	// as there is no way to know when a running request will finish.
+	concurrencyRetryAfter = 1 * time.Second
+)
+
+var throttledRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "git_auth_proxy_throttled_requests_total",
+	Help: "Total number of requests rejected by the rate or concurrency limit of a policy.",
+}, []string{"policy", "reason"})
+
+// policyLimiter enforces the rate limit of a single policy.
+type policyLimiter struct {
+	rate        *rate.Limiter
+	concurrency chan struct{}
+}
+
+// acquire reserves capacity for a request. It returns a release function if the request is
+// permitted, otherwise the reason and the duration after which the request may be retried.
+// The concurrency limit is checked first, so that rejected requests do not consume the rate.
+func (l *policyLimiter) acquire() (func(), string, time.Duration) {
+	release := func() {}
+	if l.concurrency != nil {
+		select {
+		case l.concurrency <- struct{}{}:
+			release = func() { <-l.concurrency }
+		default:
+			return nil, throttleReasonConcurrency, concurrencyRetryAfter
+		}
+	}
+	if l.rate != nil {
+		r := l.rate.Reserve()
+		if d := r.Delay(); d > 0 {
+			r.Cancel()
+			release()
+			return nil, throttleReasonRate, d
+		}
+	}
+	return release, "", 0
+}
+
+// newRateLimiters creates a limiter for every endpoint with a rate limit.
+func newRateLimiters(endpoints []*auth.Endpoint) map[string]*policyLimiter {
+	limiters := map[string]*policyLimiter{}
+	for _, e := range endpoints {
+		limit := e.RateLimit()
+		if limit == nil {
+			continue
+		}
+		l := &policyLimiter{}
+		if limit.RequestsPerMinute > 0 {
+			l.rate = rate.NewLimiter(rate.Limit(limit.RequestsPerMinute/60), max(limit.Burst, 1))
+		}
+		if limit.MaxConcurrent > 0 {
+			l.concurrency = make(chan struct{}, limit.MaxConcurrent)
+		}
+		limiters[e.ID()] = l
+	}
+	return limiters
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func getRateLimitedEndpoints(t *testing.T, limit *config.RateLimit) []*auth.Endpoint {
+	t.Helper()
+
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:       "limited",
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Repositories: []*config.Repository{
+					{
+						Owner: "org",
+						Name:  "repo",
+					},
+				},
+				UserAuth: config.UserAuth{
+					TokenHash: testTokenHash,
+				},
+				RateLimit: limit,
+			},
+			{
+				ID:       "unlimited",
+				Provider: config.GitHubProviderType,
+				Host:     "github.com",
+				Repositories: []*config.Repository{
+					{
+						Owner: "org",
+						Name:  "repo",
+					},
+				},
+				UserAuth: config.UserAuth{
+					Anonymous: true,
+				},
+			},
+		},
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	return authz.GetEndpoints()
+}
+
+func TestRateLimit(t *testing.T) {
+	limiters := newRateLimiters(getRateLimitedEndpoints(t, &config.RateLimit{RequestsPerMinute: 1, Burst: 2}))
+	require.Len(t, limiters, 1)
+	l := limiters["github.com//limited"]
+
+	for i := 0; i < 2; i++ {
+		release, _, _ := l.acquire()
+		require.NotNil(t, release)
+		release()
+	}
+	release, reason, d := l.acquire()
+	require.Nil(t, release)
+	require.Equal(t, throttleReasonRate, reason)
+	require.Greater(t, d.Seconds(), 50.0)
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	limiters := newRateLimiters(getRateLimitedEndpoints(t, &config.RateLimit{MaxConcurrent: 2}))
+	l := limiters["github.com//limited"]
+
+	first, _, _ := l.acquire()
+	require.NotNil(t, first)
+	second, _, _ := l.acquire()
+	require.NotNil(t, second)
+	release, reason, d := l.acquire()
+	require.Nil(t, release)
+	require.Equal(t, throttleReasonConcurrency, reason)
+	require.Equal(t, concurrencyRetryAfter, d)
+
+	first()
+	third, _, _ := l.acquire()
+	require.NotNil(t, third)
+	second()
+	third()
+}
+
+func TestConcurrencyLimitDoesNotConsumeRate(t *testing.T) {
+	limiters := newRateLimiters(getRateLimitedEndpoints(t, &config.RateLimit{RequestsPerMinute: 1, Burst: 2, MaxConcurrent: 1}))
+	l := limiters["github.com//limited"]
+
+	first, _, _ := l.acquire()
+	require.NotNil(t, first)
+	for i := 0; i < 3; i++ {
+		release, reason, _ := l.acquire()
+		require.Nil(t, release)
+		require.Equal(t, throttleReasonConcurrency, reason)
+	}
+	first()
+
+	// Only the first request consumed the rate, the rejected requests left the burst for the second
+	second, _, _ := l.acquire()
+	require.NotNil(t, second)
+	second()
+	release, reason, _ := l.acquire()
+	require.Nil(t, release)
+	require.Equal(t, throttleReasonRate, reason)
+}
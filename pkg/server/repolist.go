@@ -0,0 +1,289 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	pkggin "github.com/xenitab/pkg/gin"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/httpcache"
+)
+
+const (
+	listDefaultPerPage = 30
+	listMaxPerPage     = 100
+	// listFetchTimeout limits fetching all pages of a repository list, which is shared by concurrent requests.
+	listFetchTimeout = 2 * time.Minute
+	// listTruncatedHeader is set on repository lists which were truncated at the maximum number of upstream pages.
+	listTruncatedHeader = "X-Repository-List-Truncated"
+)
+
+// upstreamStatusError is returned when the upstream does not answer a list request with 200 OK.
+type upstreamStatusError struct {
+	statusCode  int
+	contentType string
+	body        []byte
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with status %d", e.statusCode)
+}
+
+type listedRepository struct {
+	FullName string `json:"full_name"`
+}
+
+// repositoryList is a repository list filtered to the repositories of a policy.
+type repositoryList struct {
+	repositories []json.RawMessage
+	wrapper      map[string]json.RawMessage
+	// truncated is true if the upstream had more pages than were fetched.
+	truncated bool
+	expires   time.Time
+}
+
+// repositoryListCache keeps the filtered repository lists of the policies for a short time, so that clients paginating
+// through a list do not cause all upstream pages to be fetched for every page. Concurrent requests for the same list
+// share a single fetch.
+type repositoryListCache struct {
+	ttl   time.Duration
+	group singleflight.Group
+
+	mu    sync.Mutex
+	lists map[string]*repositoryList
+}
+
+func newRepositoryListCache(ttl time.Duration) *repositoryListCache {
+	return &repositoryListCache{
+		ttl:   ttl,
+		lists: map[string]*repositoryList{},
+	}
+}
+
+// get returns the list of the key, which is fetched if it is not cached.
+func (l *repositoryListCache) get(key string, fetch func() (*repositoryList, error)) (*repositoryList, error) {
+	now := time.Now()
+	l.mu.Lock()
+	list, ok := l.lists[key]
+	l.mu.Unlock()
+	if ok && now.Before(list.expires) {
+		return list, nil
+	}
+	v, err, _ := l.group.Do(key, func() (interface{}, error) {
+		list, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		if l.ttl <= 0 {
+			return list, nil
+		}
+		list.expires = time.Now().Add(l.ttl)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for k, cached := range l.lists {
+			if now.After(cached.expires) {
+				delete(l.lists, k)
+			}
+		}
+		l.lists[key] = list
+		return list, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	list, ok = v.(*repositoryList)
+	if !ok {
+		return nil, fmt.Errorf("unexpected repository list type %T", v)
+	}
+	return list, nil
+}
+
+// repositoryListKey identifies the list requested by the client within the policy, independent of the requested page.
+func repositoryListKey(c *gin.Context, e *auth.Endpoint) string {
+	query := c.Request.URL.Query()
+	query.Del("page")
+	query.Del("per_page")
+	return strings.Join([]string{
+		e.ID(),
+		c.Request.URL.EscapedPath(),
+		query.Encode(),
+		c.Request.Header.Get("Accept"),
+		c.Request.Header.Get("X-GitHub-Api-Version"),
+	}, "\n")
+}
+
+// serveRepositoryList serves a repository list filtered to the repositories of the endpoint. All pages are
+// fetched from the upstream so that the filtered list can be paginated as requested by the client.
+func (g *GitProxy) serveRepositoryList(c *gin.Context, e *auth.Endpoint, r *rewriter) {
+	list, err := g.listCache.get(repositoryListKey(c, e), func() (*repositoryList, error) {
+		// The fetch is shared by concurrent requests and must not fail when the requesting client disconnects
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), listFetchTimeout)
+		defer cancel()
+		return g.fetchRepositoryList(ctx, c.Request, e)
+	})
+	if err != nil {
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) {
+			c.Data(statusErr.statusCode, statusErr.contentType, g.sanitizer.scrub(statusErr.body))
+			return
+		}
+		//nolint: errcheck //ignore
+		c.Error(fmt.Errorf("Could not list repositories: %w", err))
+		c.String(http.StatusBadGateway, "Bad gateway")
+		return
+	}
+	filtered := list.repositories
+	if list.truncated {
+		pkggin.FromContextOrDiscard(c).Info("repository list truncated", "path", c.Request.URL.Path, "pages", g.listMaxPages)
+		c.Header(listTruncatedHeader, "true")
+	}
+
+	query := c.Request.URL.Query()
+	perPage := min(max(queryInt(query, "per_page", listDefaultPerPage), 1), listMaxPerPage)
+	// All pages after the last page are empty, clamping the page keeps the offset from overflowing
+	page := min(max(queryInt(query, "page", 1), 1), (len(filtered)+perPage-1)/perPage+1)
+	start := min((page-1)*perPage, len(filtered))
+	end := min(start+perPage, len(filtered))
+	var body []byte
+	if list.wrapper != nil {
+		// The cached wrapper is shared by concurrent requests
+		wrapper := make(map[string]json.RawMessage, len(list.wrapper)+1)
+		for k, v := range list.wrapper {
+			wrapper[k] = v
+		}
+		wrapper["total_count"] = json.RawMessage(strconv.Itoa(len(filtered)))
+		wrapper["repositories"], err = json.Marshal(filtered[start:end])
+		if err == nil {
+			body, err = json.Marshal(wrapper)
+		}
+	} else {
+		body, err = json.Marshal(filtered[start:end])
+	}
+	if err != nil {
+		//nolint: errcheck //ignore
+		c.Error(fmt.Errorf("Could not encode repositories: %w", err))
+		c.String(http.StatusInternalServerError, "Internal server error")
+		return
+	}
+	if link := listLinks(r.base+c.Request.URL.EscapedPath(), query, page, perPage, len(filtered)); link != "" {
+		c.Header("Link", link)
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", r.rewriteBody(body))
+}
+
+// fetchRepositoryList returns the repositories of all pages which are permitted for the endpoint, and the object
+// wrapping them if the route does not return an array. The list is truncated at the maximum number of pages.
+func (g *GitProxy) fetchRepositoryList(ctx context.Context, origReq *http.Request, e *auth.Endpoint) (*repositoryList, error) {
+	query := origReq.URL.Query()
+	query.Set("per_page", strconv.Itoa(listMaxPerPage))
+	list := &repositoryList{repositories: []json.RawMessage{}}
+	for page := 1; page <= g.listMaxPages; page++ {
+		query.Set("page", strconv.Itoa(page))
+		body, next, err := g.fetchListPage(ctx, origReq, e, query)
+		if err != nil {
+			return nil, err
+		}
+		items := []json.RawMessage{}
+		if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+			err = json.Unmarshal(body, &items)
+		} else {
+			err = json.Unmarshal(body, &list.wrapper)
+			if err == nil {
+				err = json.Unmarshal(list.wrapper["repositories"], &items)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode repository list: %w", err)
+		}
+		for _, item := range items {
+			listed := listedRepository{}
+			if err := json.Unmarshal(item, &listed); err != nil {
+				continue
+			}
+			owner, name, ok := strings.Cut(listed.FullName, "/")
+			if ok && e.PermitsRepository(owner, name) {
+				list.repositories = append(list.repositories, item)
+			}
+		}
+		if !next {
+			return list, nil
+		}
+	}
+	list.truncated = true
+	return list, nil
+}
+
+// fetchListPage returns the body of the page and whether there is a next page.
+func (g *GitProxy) fetchListPage(ctx context.Context, origReq *http.Request, e *auth.Endpoint, query url.Values) ([]byte, bool, error) {
+	ctx = httpcache.WithScope(ctx, e.ID())
+	req := origReq.Clone(ctx)
+	req.Method = http.MethodGet
+	req.RequestURI = ""
+	req.Body = http.NoBody
+	req.ContentLength = 0
+	req.URL.RawQuery = query.Encode()
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del(proxyHeaderKey)
+	req, target, err := g.authz.UpdateRequest(ctx, req, e)
+	if err != nil {
+		return nil, false, err
+	}
+	req.URL.Scheme = target.Scheme
+	req.URL.Host = target.Host
+	resp, err := g.getTransport(e).RoundTrip(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	g.authz.ObserveResponse(resp)
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, &upstreamStatusError{statusCode: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: body}
+	}
+	return body, strings.Contains(resp.Header.Get("Link"), `rel="next"`), nil
+}
+
+// listLinks returns the Link header paginating the filtered list in the format used by GitHub.
+func listLinks(base string, query url.Values, page, perPage, total int) string {
+	last := max((total+perPage-1)/perPage, 1)
+	link := func(page int, rel string) string {
+		query.Set("page", strconv.Itoa(page))
+		query.Set("per_page", strconv.Itoa(perPage))
+		return fmt.Sprintf(`<%s?%s>; rel="%s"`, base, query.Encode(), rel)
+	}
+	links := []string{}
+	if page > 1 {
+		links = append(links, link(min(page-1, last), "prev"))
+	}
+	if page < last {
+		links = append(links, link(page+1, "next"), link(last, "last"))
+	}
+	if page > 1 {
+		links = append(links, link(1, "first"))
+	}
+	return strings.Join(links, ", ")
+}
+
+func queryInt(query url.Values, key string, fallback int) int {
+	v, err := strconv.Atoi(query.Get(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
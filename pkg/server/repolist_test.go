@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestProxyHandlerRepositoryList(t *testing.T) {
+	// The upstream lists 250 repositories of which repo-7 and repo-142 are permitted
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerKey) != "Bearer upstream-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil || r.URL.Query().Get("per_page") != "100" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		repositories := []map[string]any{}
+		for i := (page - 1) * 100; i < min(page*100, 250); i++ {
+			repositories = append(repositories, map[string]any{
+				"full_name": fmt.Sprintf("org/repo-%d", i),
+				"url":       fmt.Sprintf("http://%s/api/v3/repos/org/repo-%d", r.Host, i),
+			})
+		}
+		if page < 3 {
+			w.Header().Set("Link", `<http://example.com>; rel="next"`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		var body any = repositories
+		if r.URL.Path == "/api/v3/installation/repositories" {
+			body = map[string]any{"total_count": 250, "repository_selection": "all", "repositories": repositories}
+		}
+		//nolint: errcheck //ignore
+		json.NewEncoder(w).Encode(body)
+	}
+	proxyURL := newTestProxy(t, upstream, func(cfg *config.Configuration, _ *Config) {
+		cfg.Policies[0].Repositories = []*config.Repository{
+			{Owner: "org", Name: "repo-7"},
+			{Owner: "org", Name: "repo-142"},
+			{Owner: "other", Name: "*"},
+		}
+	})
+
+	tests := []struct {
+		name     string
+		path     string
+		expected []string
+		link     string
+		wrapped  bool
+	}{
+		{
+			name:     "org repositories",
+			path:     "/api/v3/orgs/org/repos",
+			expected: []string{"org/repo-7", "org/repo-142"},
+		},
+		{
+			name:     "first page",
+			path:     "/api/v3/user/repos?per_page=1",
+			expected: []string{"org/repo-7"},
+			link:     `<%[1]s/api/v3/user/repos?page=2&per_page=1>; rel="next", <%[1]s/api/v3/user/repos?page=2&per_page=1>; rel="last"`,
+		},
+		{
+			name:     "last page",
+			path:     "/api/v3/user/repos?per_page=1&page=2",
+			expected: []string{"org/repo-142"},
+			link:     `<%[1]s/api/v3/user/repos?page=1&per_page=1>; rel="prev", <%[1]s/api/v3/user/repos?page=1&per_page=1>; rel="first"`,
+		},
+		{
+			name:     "page after the last page",
+			path:     "/api/v3/user/repos?per_page=100&page=92233720368547760",
+			expected: []string{},
+			link:     `<%[1]s/api/v3/user/repos?page=1&per_page=100>; rel="prev", <%[1]s/api/v3/user/repos?page=1&per_page=100>; rel="first"`,
+		},
+		{
+			name:     "installation repositories",
+			path:     "/api/v3/installation/repositories",
+			expected: []string{"org/repo-7", "org/repo-142"},
+			wrapped:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, proxyURL+tt.path, nil)
+			require.NoError(t, err)
+			req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			type repository struct {
+				FullName string `json:"full_name"`
+				URL      string `json:"url"`
+			}
+			repositories := []repository{}
+			if tt.wrapped {
+				body := struct {
+					TotalCount   int          `json:"total_count"`
+					Selection    string       `json:"repository_selection"`
+					Repositories []repository `json:"repositories"`
+				}{}
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+				require.Equal(t, len(tt.expected), body.TotalCount)
+				require.Equal(t, "all", body.Selection)
+				repositories = body.Repositories
+			} else {
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&repositories))
+			}
+			names := []string{}
+			for _, r := range repositories {
+				names = append(names, r.FullName)
+				require.Equal(t, proxyURL+"/api/v3/repos/"+r.FullName, r.URL)
+			}
+			require.Equal(t, tt.expected, names)
+			expectedLink := ""
+			if tt.link != "" {
+				expectedLink = fmt.Sprintf(tt.link, proxyURL)
+			}
+			require.Equal(t, expectedLink, resp.Header.Get("Link"))
+			require.Empty(t, resp.Header.Get(listTruncatedHeader))
+		})
+	}
+}
+
+func TestProxyHandlerRepositoryListCache(t *testing.T) {
+	upstreamRequests := &atomic.Int64{}
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		page, err := strconv.Atoi(r.URL.Query().Get("page"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if page < 5 {
+			w.Header().Set("Link", `<http://example.com>; rel="next"`)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		//nolint: errcheck //ignore
+		json.NewEncoder(w).Encode([]map[string]any{{"full_name": fmt.Sprintf("org/repo-%d", page)}})
+	}
+	proxyURL := newTestProxy(t, upstream, func(cfg *config.Configuration, proxyCfg *Config) {
+		cfg.Policies[0].Repositories = []*config.Repository{{Owner: "org", Name: "*"}}
+		proxyCfg.RepositoryListMaxPages = 3
+	})
+
+	// Paginating through the filtered list only fetches the upstream pages once
+	for _, tt := range []struct {
+		path     string
+		expected string
+	}{
+		{path: "/api/v3/orgs/org/repos?per_page=1", expected: "org/repo-1"},
+		{path: "/api/v3/orgs/org/repos?per_page=1&page=2", expected: "org/repo-2"},
+		{path: "/api/v3/orgs/org/repos?per_page=1&page=3", expected: "org/repo-3"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, proxyURL+tt.path, nil)
+		require.NoError(t, err)
+		req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		repositories := []listedRepository{}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&repositories))
+		resp.Body.Close()
+		require.Equal(t, []listedRepository{{FullName: tt.expected}}, repositories)
+		// The upstream has more pages than are fetched
+		require.Equal(t, "true", resp.Header.Get(listTruncatedHeader))
+	}
+	require.Equal(t, int64(3), upstreamRequests.Load())
+}
+
+func TestProxyHandlerRepositoryListDisconnect(t *testing.T) {
+	release := make(chan struct{})
+	upstreamRequests := &atomic.Int64{}
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequests.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		//nolint: errcheck //ignore
+		json.NewEncoder(w).Encode([]map[string]any{{"full_name": "org/repo"}})
+	}
+	proxyURL := newTestProxy(t, upstream, nil)
+	newRequest := func(ctx context.Context) *http.Request {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, proxyURL+"/api/v3/orgs/org/repos", nil)
+		require.NoError(t, err)
+		req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+		return req
+	}
+
+	// The first client disconnects while the list is fetched for it
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		resp, err := http.DefaultClient.Do(newRequest(ctx))
+		if err == nil {
+			resp.Body.Close()
+		}
+		first <- err
+	}()
+	require.Eventually(t, func() bool {
+		return upstreamRequests.Load() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	second := make(chan *http.Response)
+	go func() {
+		resp, err := http.DefaultClient.Do(newRequest(context.Background()))
+		if err != nil {
+			second <- nil
+			return
+		}
+		second <- resp
+	}()
+	cancel()
+	require.Error(t, <-first)
+	close(release)
+
+	// The second client shares the fetch, which is not cancelled with the first client
+	resp := <-second
+	require.NotNil(t, resp)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int64(1), upstreamRequests.Load())
+}
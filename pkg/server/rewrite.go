@@ -0,0 +1,113 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+)
+
+var (
+	linkURLPattern = regexp.MustCompile(`<([^>]*)>`)
+	jsonURLPattern = regexp.MustCompile(`"(?:url|clone_url|html_url)"\s*:\s*"([^"\\]*)"`)
+)
+
+type rewriterContextKey struct{}
+
+// rewriter rewrites upstream URLs in responses so that clients following them stay on the proxy.
+type rewriter struct {
+	authz    *auth.Authorizer
+	endpoint *auth.Endpoint
+	// base is the external URL of the proxy without a trailing slash.
+	base string
+	// body enables rewriting URL fields of JSON responses.
+	body bool
+}
+
+func withRewriter(ctx context.Context, r *rewriter) context.Context {
+	return context.WithValue(ctx, rewriterContextKey{}, r)
+}
+
+func rewriterFromContext(ctx context.Context) *rewriter {
+	r, ok := ctx.Value(rewriterContextKey{}).(*rewriter)
+	if !ok {
+		return nil
+	}
+	return r
+}
+
+// baseURL returns the URL clients use to reach the proxy, derived from the request unless configured.
+func (g *GitProxy) baseURL(c *gin.Context) string {
+	if g.externalURL != "" {
+		return g.externalURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+func (r *rewriter) rewriteURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() {
+		return s
+	}
+	path, ok := r.authz.ProxyPath(r.endpoint, u)
+	if !ok {
+		return s
+	}
+	return r.base + path
+}
+
+// rewriteResponse rewrites the Location and Link headers and the URL fields of JSON API responses.
+func (r *rewriter) rewriteResponse(resp *http.Response) error {
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", r.rewriteURL(location))
+	}
+	if links := resp.Header.Values("Link"); len(links) > 0 {
+		rewritten := make([]string, 0, len(links))
+		for _, link := range links {
+			rewritten = append(rewritten, linkURLPattern.ReplaceAllStringFunc(link, func(m string) string {
+				return "<" + r.rewriteURL(m[1:len(m)-1]) + ">"
+			}))
+		}
+		resp.Header["Link"] = rewritten
+	}
+	if !r.body || resp.Header.Get("Content-Encoding") != "" || !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := resp.Body.Close(); err != nil {
+		return err
+	}
+	body = r.rewriteBody(body)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// rewriteBody rewrites the URL fields of a JSON body.
+func (r *rewriter) rewriteBody(body []byte) []byte {
+	return jsonURLPattern.ReplaceAllFunc(body, func(m []byte) []byte {
+		sub := jsonURLPattern.FindSubmatchIndex(m)
+		value := string(m[sub[2]:sub[3]])
+		rewritten := r.rewriteURL(value)
+		if rewritten == value {
+			return m
+		}
+		return append(append(append([]byte{}, m[:sub[2]]...), rewritten...), m[sub[3]:]...)
+	})
+}
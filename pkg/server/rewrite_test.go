@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHandlerRewrite(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		base := "http://" + r.Host
+		switch r.URL.Path {
+		case "/api/v3/repos/org/repo":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Header().Set("Link", fmt.Sprintf(`<%[1]s/api/v3/repos/org/repo?page=2>; rel="next", <https://example.com/other>; rel="last"`, base))
+			fmt.Fprintf(w, `{"url":"%[1]s/api/v3/repos/org/repo","clone_url": "%[1]s/org/repo.git","html_url":"%[1]s/org/repo","homepage":"%[1]s/org/repo","mirror_url":"https://example.com/repo"}`, base)
+		case "/org/repo/info/refs":
+			w.Header().Set("Location", base+"/org/repo.git/info/refs?service=git-upload-pack")
+			w.WriteHeader(http.StatusMovedPermanently)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	proxyURL := newTestProxy(t, upstream, nil)
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, proxyURL+"/api/v3/repos/org/repo", nil)
+	require.NoError(t, err)
+	req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	expected := fmt.Sprintf(`{"url":"%[1]s/api/v3/repos/org/repo","clone_url": "%[1]s/org/repo.git","html_url":"%[1]s/org/repo","homepage":"`, proxyURL)
+	require.Contains(t, string(body), expected)
+	require.NotContains(t, string(body), `"homepage":"`+proxyURL)
+	require.Contains(t, string(body), `"mirror_url":"https://example.com/repo"`)
+	require.Equal(t, fmt.Sprintf(`<%s/api/v3/repos/org/repo?page=2>; rel="next", <https://example.com/other>; rel="last"`, proxyURL), resp.Header.Get("Link"))
+
+	req, err = http.NewRequest(http.MethodGet, proxyURL+"/org/repo/info/refs", nil)
+	require.NoError(t, err)
+	req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	require.Equal(t, proxyURL+"/org/repo.git/info/refs?service=git-upload-pack", resp.Header.Get("Location"))
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/legobeat/git-auth-proxy/pkg/redact"
+)
+
+// DefaultStripResponseHeaders returns the upstream response headers which reveal properties of the upstream credentials.
+func DefaultStripResponseHeaders() []string {
+	return []string{
+		"X-OAuth-Scopes",
+		"X-Accepted-OAuth-Scopes",
+		"X-OAuth-Client-Id",
+		"X-GitHub-SSO",
+		"X-GitHub-Authentication-Token-Expiration",
+		"X-RateLimit-*",
+	}
+}
+
+// responseSanitizer removes information about the upstream credentials from upstream responses.
+type responseSanitizer struct {
+	headers  map[string]bool
+	prefixes []string
+	tokens   *strings.Replacer
+}
+
+// newResponseSanitizer returns a sanitizer stripping the headers, a trailing "*" matches any header with the prefix,
+// and scrubbing the tokens from error bodies.
+func newResponseSanitizer(headers, tokens []string) *responseSanitizer {
+	s := &responseSanitizer{headers: map[string]bool{}}
+	for _, h := range headers {
+		if prefix, ok := strings.CutSuffix(h, "*"); ok {
+			s.prefixes = append(s.prefixes, http.CanonicalHeaderKey(prefix))
+			continue
+		}
+		s.headers[http.CanonicalHeaderKey(h)] = true
+	}
+	oldnew := []string{}
+	for _, token := range tokens {
+		// Tokens are also echoed in the encodings used for the upstream authorization header
+		for _, v := range redact.SecretForms(token) {
+			oldnew = append(oldnew, v, redact.Redacted)
+		}
+	}
+	if len(oldnew) > 0 {
+		s.tokens = strings.NewReplacer(oldnew...)
+	}
+	return s
+}
+
+func (s *responseSanitizer) stripHeaders(header http.Header) {
+	for k := range header {
+		if s.headers[k] {
+			header.Del(k)
+			continue
+		}
+		for _, prefix := range s.prefixes {
+			if strings.HasPrefix(k, prefix) {
+				header.Del(k)
+				break
+			}
+		}
+	}
+}
+
+func (s *responseSanitizer) scrub(body []byte) []byte {
+	if s.tokens == nil {
+		return body
+	}
+	return []byte(s.tokens.Replace(string(body)))
+}
+
+// sanitize strips the headers of the response and scrubs the tokens from error bodies. Compressed error bodies
+// are decompressed to be scrubbed, and replaced by the status text if the encoding is not supported.
+func (s *responseSanitizer) sanitize(resp *http.Response) error {
+	s.stripHeaders(resp.Header)
+	if resp.StatusCode < http.StatusBadRequest || s.tokens == nil {
+		return nil
+	}
+	body, err := readDecodedBody(resp)
+	if err != nil {
+		return err
+	}
+	if err := resp.Body.Close(); err != nil {
+		return err
+	}
+	body = s.scrub(body)
+	resp.Header.Del("Content-Encoding")
+	resp.Uncompressed = true
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// readDecodedBody reads the body of the response and decodes its content encoding.
+func readDecodedBody(resp *http.Response) ([]byte, error) {
+	var r io.Reader
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		r = resp.Body
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return []byte(http.StatusText(resp.StatusCode)), nil
+		}
+		r = gr
+	case "deflate":
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return []byte(http.StatusText(resp.StatusCode)), nil
+		}
+		r = zr
+	default:
+		//nolint: errcheck //ignore
+		io.Copy(io.Discard, resp.Body)
+		return []byte(http.StatusText(resp.StatusCode)), nil
+	}
+	body, err := io.ReadAll(r)
+	if err != nil && resp.Header.Get("Content-Encoding") != "" {
+		// A corrupt body cannot be scrubbed
+		return []byte(http.StatusText(resp.StatusCode)), nil
+	}
+	return body, err
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestProxyHandlerSanitize(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-OAuth-Scopes", "repo, admin:org")
+		w.Header().Set("X-GitHub-SSO", "required; url=https://github.com/orgs/org/sso")
+		w.Header().Set("X-RateLimit-Remaining", "4999")
+		w.Header().Set("X-GitHub-Request-Id", "1234")
+		body := []byte("invalid credentials upstream-token")
+		switch r.URL.Path {
+		case "/org/repo/info/refs":
+			w.WriteHeader(http.StatusUnauthorized)
+			//nolint: errcheck //ignore
+			w.Write([]byte("invalid credentials " + r.Header.Get(headerKey) + " upstream-token"))
+			return
+		case "/org/gzip/info/refs":
+			var buf bytes.Buffer
+			gw := gzip.NewWriter(&buf)
+			//nolint: errcheck //ignore
+			gw.Write(body)
+			//nolint: errcheck //ignore
+			gw.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			w.WriteHeader(http.StatusUnauthorized)
+			//nolint: errcheck //ignore
+			w.Write(buf.Bytes())
+			return
+		case "/org/br/info/refs":
+			w.Header().Set("Content-Encoding", "br")
+			w.WriteHeader(http.StatusUnauthorized)
+			//nolint: errcheck //ignore
+			w.Write(body)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		//nolint: errcheck //ignore
+		w.Write([]byte("upstream-token"))
+	}
+	proxyURL := newTestProxy(t, upstream, func(cfg *config.Configuration, _ *Config) {
+		cfg.Policies[0].Repositories = append(cfg.Policies[0].Repositories,
+			&config.Repository{Owner: "org", Name: "gzip"},
+			&config.Repository{Owner: "org", Name: "br"},
+		)
+	})
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		body   string
+	}{
+		{
+			name:   "error body",
+			path:   "/org/repo/info/refs",
+			status: http.StatusUnauthorized,
+			body:   "invalid credentials Basic [REDACTED] [REDACTED]",
+		},
+		{
+			name:   "gzip error body",
+			path:   "/org/gzip/info/refs",
+			status: http.StatusUnauthorized,
+			body:   "invalid credentials [REDACTED]",
+		},
+		{
+			name:   "unsupported encoding error body",
+			path:   "/org/br/info/refs",
+			status: http.StatusUnauthorized,
+			body:   "Unauthorized",
+		},
+		{
+			name:   "success body",
+			path:   "/org/repo/git-upload-pack",
+			status: http.StatusOK,
+			body:   "upstream-token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, proxyURL+tt.path, nil)
+			require.NoError(t, err)
+			req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+			// Git sends Accept-Encoding itself, so the client does not decompress responses transparently
+			req.Header.Set("Accept-Encoding", "gzip, br")
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.status, resp.StatusCode)
+			require.Equal(t, tt.body, string(body))
+			require.Empty(t, resp.Header.Get("X-OAuth-Scopes"))
+			require.Empty(t, resp.Header.Get("X-GitHub-SSO"))
+			require.Empty(t, resp.Header.Get("X-RateLimit-Remaining"))
+			require.Equal(t, "1234", resp.Header.Get("X-GitHub-Request-Id"))
+			require.Empty(t, resp.Header.Get("Content-Encoding"))
+		})
+	}
+}
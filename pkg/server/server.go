@@ -2,68 +2,426 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-logr/logr"
 	pkggin "github.com/xenitab/pkg/gin"
 
+	"github.com/legobeat/git-auth-proxy/pkg/audit"
 	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/httpcache"
+	"github.com/legobeat/git-auth-proxy/pkg/mirror"
 )
 
+const authenticateHeaderValue = `Basic realm="git-auth-proxy"`
+
+// Config contains the proxy settings which are not part of the policy configuration.
+type Config struct {
+	// UsernameAsPolicyID treats the username of Basic credentials as the ID of the policy to check the token against.
+	UsernameAsPolicyID bool
+	// TrustedProxies are the networks whose forwarding headers are trusted to determine the client IP.
+	TrustedProxies []string
+	// Lockout configures the backoff after failed authentication attempts.
+	Lockout LockoutConfig
+	// Transport configures the connections to the upstreams.
+	Transport TransportConfig
+	// Mirror serves fetches and clones from local mirrors if set.
+	Mirror *mirror.Cache
+	// ResponseCache caches API responses and revalidates them with conditional requests if set.
+	ResponseCache httpcache.Store
+	// ResponseCacheMaxBodySize is the largest response body which is cached.
+	ResponseCacheMaxBodySize int64
+	// ExternalURL is the URL clients use to reach the proxy, upstream URLs in responses are rewritten to it.
+	// It is derived from the request if empty.
+	ExternalURL string
+	// RepositoryListMaxPages is the maximum number of upstream pages fetched to filter a repository list.
+	RepositoryListMaxPages int
+	// RepositoryListCacheTTL is the duration filtered repository lists are cached for, zero disables the cache.
+	RepositoryListCacheTTL time.Duration
+	// StripResponseHeaders are removed from upstream responses, a trailing "*" matches any header with the prefix.
+	StripResponseHeaders []string
+	// Audit receives an event for every request and lockout, events are discarded if it is nil.
+	Audit *audit.Logger
+}
+
+func DefaultConfig() Config {
+	return Config{
+		UsernameAsPolicyID: false,
+		TrustedProxies:     nil,
+		Lockout: LockoutConfig{
+			Threshold: 10,
+			BaseDelay: 1 * time.Second,
+			MaxDelay:  15 * time.Minute,
+			Window:    15 * time.Minute,
+		},
+		Transport:                DefaultTransportConfig(),
+		ResponseCacheMaxBodySize: 1 << 20,
+		RepositoryListMaxPages:   10,
+		RepositoryListCacheTTL:   1 * time.Minute,
+		StripResponseHeaders:     DefaultStripResponseHeaders(),
+	}
+}
+
 type GitProxy struct {
-	authz *auth.Authorizer
+	authz          *auth.Authorizer
+	extractor      CredentialExtractor
+	failures       *failureTracker
+	limiters       map[string]*policyLimiter
+	trustedProxies []string
+	transport      *http.Transport
+	roundTripper   http.RoundTripper
+	roundTrippers  map[string]http.RoundTripper
+	bufferPool     httputil.BufferPool
+	proxies        *proxyCache
+	mirror         *mirror.Cache
+	externalURL    string
+	listMaxPages   int
+	listCache      *repositoryListCache
+	sanitizer      *responseSanitizer
+	audit          *audit.Logger
+}
+
+func NewGitProxy(authz *auth.Authorizer, cfg Config) (*GitProxy, error) {
+	g := &GitProxy{
+		authz:          authz,
+		extractor:      NewCredentialExtractor(cfg.UsernameAsPolicyID),
+		failures:       newFailureTracker(cfg.Lockout),
+		limiters:       newRateLimiters(authz.GetEndpoints()),
+		trustedProxies: cfg.TrustedProxies,
+		transport:      NewTransport(cfg.Transport),
+		roundTrippers:  map[string]http.RoundTripper{},
+		bufferPool:     newBufferPool(cfg.Transport.BufferSize),
+		mirror:         cfg.Mirror,
+		externalURL:    strings.TrimSuffix(cfg.ExternalURL, "/"),
+		listMaxPages:   cfg.RepositoryListMaxPages,
+		listCache:      newRepositoryListCache(cfg.RepositoryListCacheTTL),
+		sanitizer:      newResponseSanitizer(cfg.StripResponseHeaders, authz.UpstreamTokens()),
+		audit:          cfg.Audit,
+	}
+	g.roundTripper = newRoundTripper(g.transport, cfg)
+	for _, e := range authz.GetEndpoints() {
+		if e.Upstream() == nil {
+			continue
+		}
+		transport, err := newUpstreamTransport(g.transport, e.Upstream())
+		if err != nil {
+			return nil, fmt.Errorf("could not create transport for %s: %w", e.ID(), err)
+		}
+		g.roundTrippers[e.ID()] = newRoundTripper(transport, cfg)
+	}
+	g.proxies = newProxyCache(g.newReverseProxy)
+	return g, nil
 }
 
-func NewGitProxy(authz *auth.Authorizer) *GitProxy {
-	return &GitProxy{
-		authz: authz,
+// newRoundTripper instruments the transport and wraps it with the response cache if it is enabled.
+func newRoundTripper(transport http.RoundTripper, cfg Config) http.RoundTripper {
+	transport = &instrumentedTransport{next: transport}
+	if cfg.ResponseCache == nil {
+		return transport
 	}
+	return &httpcache.Transport{Next: transport, Store: cfg.ResponseCache, MaxBodySize: cfg.ResponseCacheMaxBodySize}
 }
 
-func (g *GitProxy) Server(ctx context.Context, addr string) *http.Server {
+// getTransport returns the transport used for upstream requests of the endpoint.
+func (g *GitProxy) getTransport(e *auth.Endpoint) http.RoundTripper {
+	if transport, ok := g.roundTrippers[e.ID()]; ok {
+		return transport
+	}
+	return g.roundTripper
+}
+
+// Server returns the proxy server. The server serves TLS if tlsCfg is not nil.
+func (g *GitProxy) Server(ctx context.Context, addr string, tlsCfg *tls.Config) (*http.Server, error) {
 	cfg := pkggin.DefaultConfig()
 	cfg.LogConfig.Logger = logr.FromContextOrDiscard(ctx)
 	cfg.MetricsConfig.HandlerID = "proxy"
 	router := pkggin.NewEngine(cfg)
+	if err := router.SetTrustedProxies(g.trustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %w", err)
+	}
 	router.GET("/readyz", readinessHandler)
 	router.GET("/healthz", livenessHandler)
 	router.NoRoute(g.proxyHandler)
 	// The ReadTimeout is set to 5 min make sure that strange requests don't live forever
 	// But in general the external request should set a good timeout value for it's request.
-	srv := &http.Server{ReadTimeout: 5 * time.Minute, Addr: addr, Handler: router}
-	return srv
+	srv := &http.Server{ReadTimeout: 5 * time.Minute, Addr: addr, Handler: router, TLSConfig: tlsCfg}
+	return srv, nil
 }
 
 func (g *GitProxy) proxyHandler(c *gin.Context) {
-	// Get the token from the request
-	// error is fine; we fall back to "", the default public policy, if any
-	//nolint: ineffassign,staticcheck //ignore
-	token, err := getTokenFromRequest(c.Request)
-	// Check basic auth with local auth configuration
-	err = g.authz.IsPermitted(c.Request.URL.EscapedPath(), token)
-	if err != nil {
+	span := startServerSpan(c)
+	// Get the credentials from the request, a request without credentials may match an anonymous policy
+	id := auth.Identity{
+		Certificate: getCertificateFromRequest(c.Request),
+	}
+	creds, err := g.extractor.Extract(c.Request)
+	event := newAuditEvent(c, creds)
+	event.Decision = decisionDenied
+	var endpoint *auth.Endpoint
+	var body *countingReader
+	if c.Request.Body != nil && c.Request.Body != http.NoBody {
+		body = &countingReader{ReadCloser: c.Request.Body}
+		c.Request.Body = body
+	}
+	defer func() {
+		g.audit.Log(event)
+		recordRequest(c, event, endpoint, body)
+		endServerSpan(c, span, event)
+	}()
+	keys := lockoutKeys(c, creds, g.failures.cfg.ByIP)
+	// Client IPs are locked out before their credentials are checked. Anyone can present any username,
+	// so a locked out username only rejects requests whose token fails verification as well.
+	if d := g.failures.lockedFor(keysOfKind(keys, lockoutKeyIP)...); d > 0 {
+		lockedOut(c, event, d)
+		return
+	}
+	if err != nil && !errors.Is(err, ErrNoCredentials) {
+		//nolint: errcheck //ignore
+		c.Error(fmt.Errorf("Received invalid credentials: %w", err))
+		requestsTotal.WithLabelValues(authNone, authNone, decisionDenied).Inc()
+		event.Reason = reasonInvalidCredentials
+		g.authenticationFailed(c, event, keys)
+		return
+	}
+	if creds != nil {
+		id.Token = creds.Token
+		id.PolicyID = creds.PolicyID
+	}
+	// Check the client credentials with local auth configuration
+	endpoint, err = g.authz.Authorize(c.Request.Context(), id, c.Request.Method, c.Request.URL.EscapedPath())
+	event.Auth = authMethod(id, endpoint)
+	auditDenied := errors.Is(err, auth.ErrAuditDenied)
+	if err != nil && !auditDenied {
+		requestsTotal.WithLabelValues(authNone, authMethod(id, nil), decisionDenied).Inc()
 		//nolint: errcheck //ignore
 		c.Error(fmt.Errorf("Received unauthorized request: %w", err))
+		if errors.Is(err, auth.ErrNotAuthenticated) {
+			event.Reason = reasonNotAuthenticated
+			if id.Token == "" {
+				unauthorized(c)
+				return
+			}
+			g.authenticationFailed(c, event, keys)
+			return
+		}
+		event.Reason = reasonNotPermitted
 		c.String(http.StatusForbidden, "User not permitted")
 		return
 	}
-	// Authenticate the request with the proper token
-	req, url, err := g.authz.UpdateRequest(c.Request.Context(), c.Request, token)
+	event.Policy = endpoint.ID()
+	c.Request = c.Request.WithContext(withMetricLabels(c.Request.Context(), policyLabel(endpoint), serviceLabel(event.Service)))
+	decision := decisionAllowed
+	if auditDenied {
+		// The policy is being rolled out, the request is proxied but reported as it would have been denied
+		decision = decisionAuditDenied
+		event.Reason = reasonNotPermitted
+		pkggin.FromContextOrDiscard(c).Info("request would be denied by policy in audit mode", "policy", endpoint.ID(), "error", err.Error())
+	}
+	requestsTotal.WithLabelValues(policyLabel(endpoint), authMethod(id, endpoint), decision).Inc()
+	if id.Token != "" {
+		g.failures.success(keysOfKind(keys, lockoutKeyUsername)...)
+	}
+	if limiter, ok := g.limiters[endpoint.ID()]; ok {
+		release, reason, d := limiter.acquire()
+		if release == nil {
+			throttledRequestsTotal.WithLabelValues(policyLabel(endpoint), reason).Inc()
+			event.Reason = reason + "_limited"
+			//nolint: errcheck //ignore
+			c.Error(fmt.Errorf("Request exceeded %s limit of policy %s", reason, endpoint.ID()))
+			c.Header("Retry-After", retryAfter(d))
+			c.String(http.StatusTooManyRequests, "Rate limit exceeded")
+			return
+		}
+		defer release()
+	}
+	event.Decision = decision
+	if g.serveMirror(c, endpoint) {
+		event.Reason = reasonMirror
+		event.UpstreamStatus = c.Writer.Status()
+		return
+	}
+	// Authenticate the request with the proper token, API reads may be answered from the cache of the policy
+	ctx := c.Request.Context()
+	api := isAPIPath(c.Request.URL.Path)
+	if api {
+		ctx = httpcache.WithScope(ctx, endpoint.ID())
+		// Let the transport decompress API responses so that their URLs can be rewritten
+		c.Request.Header.Del("Accept-Encoding")
+	}
+	rw := &rewriter{authz: g.authz, endpoint: endpoint, base: g.baseURL(c), body: api}
+	if endpoint.IsRepositoryList(c.Request.Method, c.Request.URL.Path) {
+		g.serveRepositoryList(c, endpoint, rw)
+		event.Reason = reasonRepositoryList
+		event.UpstreamStatus = c.Writer.Status()
+		return
+	}
+	ctx = withRewriter(ctx, rw)
+	req, target, err := g.authz.UpdateRequest(ctx, c.Request, endpoint)
 	if err != nil {
 		//nolint: errcheck //ignore
 		c.Error(fmt.Errorf("Could not authenticate request: %w", err))
+		event.Decision = decisionError
+		event.Reason = reasonUpstreamAuth
 		c.String(http.StatusInternalServerError, "Internal server error")
 		return
 	}
 
-	// TODO (Philip): Add caching of the proxy
 	// Forward the request to the correct proxy
-	proxy := httputil.NewSingleHostReverseProxy(url)
-	proxy.ServeHTTP(c.Writer, req)
+	g.proxies.get(target, g.getTransport(endpoint)).ServeHTTP(c.Writer, req)
+	event.Credential = auth.UpstreamCredentialLabel(req.Context())
+	event.UpstreamStatus = c.Writer.Status()
+}
+
+// serveMirror serves upload-pack requests from the mirror cache. It returns false if the
+// request has to be proxied to the upstream instead.
+func (g *GitProxy) serveMirror(c *gin.Context, e *auth.Endpoint) bool {
+	if g.mirror == nil {
+		return false
+	}
+	owner, name, ok := mirror.ParsePath(c.Request)
+	if !ok {
+		return false
+	}
+	upstream, err := g.mirrorUpstream(c.Request.Context(), e, owner, name)
+	if err == nil {
+		err = g.mirror.Serve(c.Writer, c.Request, upstream)
+	}
+	if err != nil {
+		pkggin.FromContextOrDiscard(c).Error(err, "could not serve from mirror, proxying to upstream", "owner", owner, "name", name)
+		return false
+	}
+	return true
+}
+
+// mirrorUpstream returns the upstream of the repository with the endpoint's credentials and connection settings.
+func (g *GitProxy) mirrorUpstream(ctx context.Context, e *auth.Endpoint, owner, name string) (mirror.Upstream, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("/%s/%s.git", owner, name), nil)
+	if err != nil {
+		return mirror.Upstream{}, err
+	}
+	req, target, err := g.authz.UpdateRequest(ctx, req, e)
+	if err != nil {
+		return mirror.Upstream{}, err
+	}
+	// Mirrors are not shared between policies, as their upstream credentials may not grant the same access
+	upstream := mirror.Upstream{
+		Scope:         e.ID(),
+		URL:           fmt.Sprintf("%s://%s%s", target.Scheme, req.Host, req.URL.Path),
+		Authorization: req.Header.Get("Authorization"),
+		GitConfig:     map[string]string{},
+	}
+	if u := e.Upstream(); u != nil {
+		if u.CAFile != "" {
+			upstream.GitConfig["http.sslCAInfo"] = u.CAFile
+		}
+		if u.CertFile != "" {
+			upstream.GitConfig["http.sslCert"] = u.CertFile
+			upstream.GitConfig["http.sslKey"] = u.KeyFile
+		}
+		if u.InsecureSkipVerify {
+			upstream.GitConfig["http.sslVerify"] = "false"
+		}
+		if u.Proxy != "" {
+			upstream.GitConfig["http.proxy"] = u.Proxy
+		}
+	}
+	return upstream, nil
+}
+
+// newReverseProxy returns a reverse proxy for the upstream using the given transport.
+func (g *GitProxy) newReverseProxy(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	proxy.BufferPool = g.bufferPool
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// Rate limits are observed before the headers are stripped
+		g.authz.ObserveResponse(resp)
+		if err := g.sanitizer.sanitize(resp); err != nil {
+			return err
+		}
+		if r := rewriterFromContext(resp.Request.Context()); r != nil {
+			return r.rewriteResponse(resp)
+		}
+		return nil
+	}
+	return proxy
+}
+
+// authenticationFailed records a failed authentication attempt and emits an audit event if the client got locked out.
+// The request is rejected as locked out if a username of the attempt already was, otherwise as unauthorized.
+func (g *GitProxy) authenticationFailed(c *gin.Context, event *audit.Event, keys []lockoutKey) {
+	d := g.failures.lockedFor(keysOfKind(keys, lockoutKeyUsername)...)
+	for key, d := range g.failures.failure(keys...) {
+		g.audit.Log(newLockoutEvent(c, key, d))
+	}
+	if d > 0 {
+		lockedOut(c, event, d)
+		return
+	}
+	unauthorized(c)
+}
+
+// lockedOut rejects the request of a locked out client.
+func lockedOut(c *gin.Context, event *audit.Event, d time.Duration) {
+	event.Reason = reasonLockedOut
+	authLockedRequestsTotal.Inc()
+	//nolint: errcheck //ignore
+	c.Error(fmt.Errorf("Received request from locked out client"))
+	c.Header("Retry-After", retryAfter(d))
+	c.String(http.StatusTooManyRequests, "Too many failed authentication attempts")
+}
+
+// lockoutKeys returns the keys failed authentication attempts are tracked by. The client IP is only tracked if enabled,
+// as all clients share the IP of a proxy in front of this one unless it is trusted. The username is only tracked when it
+// selects the policy the token is checked against, as usernames are otherwise arbitrary values shared by many clients,
+// such as git or x-access-token, or the token itself.
+func lockoutKeys(c *gin.Context, creds *Credentials, byIP bool) []lockoutKey {
+	keys := []lockoutKey{}
+	if byIP {
+		keys = append(keys, lockoutKey{kind: lockoutKeyIP, value: c.ClientIP()})
+	}
+	if creds != nil && creds.PolicyID != "" {
+		keys = append(keys, lockoutKey{kind: lockoutKeyUsername, value: creds.PolicyID})
+	}
+	return keys
+}
+
+// keysOfKind returns the keys of the kind. A successful attempt only resets the username keys, so that valid
+// credentials cannot be used to reset the failure count of a client IP.
+func keysOfKind(keys []lockoutKey, kind string) []lockoutKey {
+	filtered := []lockoutKey{}
+	for _, key := range keys {
+		if key.kind == kind {
+			filtered = append(filtered, key)
+		}
+	}
+	return filtered
+}
+
+// isAPIPath returns true if the path is a REST API route.
+func isAPIPath(path string) bool {
+	return strings.HasPrefix(path, "/api/v3/") || strings.HasPrefix(path, "/repos/")
+}
+
+// retryAfter formats the duration in whole seconds, rounded up.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// unauthorized responds with a challenge so that git prompts for credentials or asks its credential helpers.
+func unauthorized(c *gin.Context) {
+	c.Header("WWW-Authenticate", authenticateHeaderValue)
+	c.String(http.StatusUnauthorized, "Authentication required")
 }
 
 func readinessHandler(c *gin.Context) {
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+// mkpasswd -m sha512crypt incoming-test-token
+const testTokenHash = "$6$NmUowWy4LgRFWSsY$fOVzziH1IYD84dW8qSHa4X9PSHlo4R52oTx4jzvrR5vWkepDM/sWC.zbgrZ1IZ90zBoUGoEGCLQdbpaMbWtou."
+
+// newTestProxy starts a proxy in front of the upstream handler and returns the proxy URL.
+func newTestProxy(t *testing.T, upstream http.HandlerFunc, modify func(*config.Configuration, *Config)) string {
+	t.Helper()
+
+	upstreamSrv := httptest.NewServer(upstream)
+	t.Cleanup(upstreamSrv.Close)
+	upstreamURL, err := url.Parse(upstreamSrv.URL)
+	require.NoError(t, err)
+
+	cfg := &config.Configuration{
+		Policies: []*config.Policy{
+			{
+				ID:       "test",
+				Provider: config.GitHubProviderType,
+				GitHub: config.GitHub{
+					Token: "upstream-token",
+				},
+				Host:   upstreamURL.Host,
+				Scheme: upstreamURL.Scheme,
+				Repositories: []*config.Repository{
+					{
+						Owner: "org",
+						Name:  "repo",
+					},
+				},
+				UserAuth: config.UserAuth{
+					TokenHash: testTokenHash,
+				},
+			},
+		},
+	}
+	proxyCfg := DefaultConfig()
+	if modify != nil {
+		modify(cfg, &proxyCfg)
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	require.NoError(t, err)
+	gp, err := NewGitProxy(authz, proxyCfg)
+	require.NoError(t, err)
+	srv, err := gp.Server(context.Background(), "", nil)
+	require.NoError(t, err)
+	proxySrv := httptest.NewServer(srv.Handler)
+	t.Cleanup(proxySrv.Close)
+	return proxySrv.URL
+}
+
+func basicAuth(username, password string) string {
+	return basicKey + b64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+func TestProxyHandlerAuthentication(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerKey) != basicAuth("x-access-token", "upstream-token") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	tests := []struct {
+		name           string
+		path           string
+		authorization  string
+		expectedStatus int
+	}{
+		{
+			name:           "valid token",
+			path:           "/org/repo/info/refs",
+			authorization:  basicAuth("git", "incoming-test-token"),
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "missing credentials",
+			path:           "/org/repo/info/refs",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "malformed credentials",
+			path:           "/org/repo/info/refs",
+			authorization:  basicKey + "!!!",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "invalid token",
+			path:           "/org/repo/info/refs",
+			authorization:  basicAuth("git", "invalid-token"),
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "repository not permitted",
+			path:           "/org/other/info/refs",
+			authorization:  basicAuth("git", "incoming-test-token"),
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL := newTestProxy(t, upstream, nil)
+			req, err := http.NewRequest(http.MethodGet, proxyURL+tt.path, nil)
+			require.NoError(t, err)
+			if tt.authorization != "" {
+				req.Header.Set(headerKey, tt.authorization)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus == http.StatusUnauthorized {
+				require.Equal(t, authenticateHeaderValue, resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestProxyHandlerLockout(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	proxyURL := newTestProxy(t, upstream, func(_ *config.Configuration, proxyCfg *Config) {
+		proxyCfg.Lockout.Threshold = 2
+		proxyCfg.Lockout.BaseDelay = time.Minute
+		proxyCfg.Lockout.ByIP = true
+	})
+	do := func(password string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, proxyURL+"/org/repo/info/refs", nil)
+		require.NoError(t, err)
+		req.Header.Set(headerKey, basicAuth("git", password))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	require.Equal(t, http.StatusOK, do("incoming-test-token").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do("invalid-token").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do("invalid-token").StatusCode)
+	resp := do("incoming-test-token")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+}
+
+func TestProxyHandlerLockoutUsername(t *testing.T) {
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	proxyURL := newTestProxy(t, upstream, func(_ *config.Configuration, proxyCfg *Config) {
+		proxyCfg.UsernameAsPolicyID = true
+		proxyCfg.Lockout.Threshold = 2
+		proxyCfg.Lockout.BaseDelay = time.Minute
+	})
+	do := func(password string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, proxyURL+"/org/repo/info/refs", nil)
+		require.NoError(t, err)
+		req.Header.Set(headerKey, basicAuth("test", password))
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	require.Equal(t, http.StatusUnauthorized, do("invalid-token").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do("invalid-token").StatusCode)
+	resp := do("invalid-token")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.NotEmpty(t, resp.Header.Get("Retry-After"))
+	// Failures of others do not lock out clients of the policy with a valid token, and client IPs are not tracked by default
+	require.Equal(t, http.StatusOK, do("incoming-test-token").StatusCode)
+	require.Equal(t, http.StatusUnauthorized, do("invalid-token").StatusCode)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeCertificate(t *testing.T, dir, commonName string, modTime time.Time) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	require.NoError(t, err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+func getCommonName(t *testing.T, r *CertificateReloader) string {
+	t.Helper()
+
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeCertificate(t, dir, "first", now.Add(-time.Minute))
+	r, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+	require.Equal(t, "first", getCommonName(t, r))
+
+	reloaded, err := r.reload()
+	require.NoError(t, err)
+	require.False(t, reloaded)
+
+	writeCertificate(t, dir, "second", now)
+	reloaded, err = r.reload()
+	require.NoError(t, err)
+	require.True(t, reloaded)
+	require.Equal(t, "second", getCommonName(t, r))
+
+	err = os.WriteFile(certFile, []byte("invalid"), 0o600)
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute)))
+	_, err = r.reload()
+	require.Error(t, err)
+	require.Equal(t, "second", getCommonName(t, r))
+}
+
+func TestCertificateReloaderDisabled(t *testing.T) {
+	certFile, keyFile := writeCertificate(t, t.TempDir(), "first", time.Now())
+	r, err := NewCertificateReloader(certFile, keyFile)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, r.Run(ctx, 0))
+}
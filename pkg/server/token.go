@@ -2,58 +2,148 @@ package server
 
 import (
 	b64 "encoding/base64"
+	"errors"
 	"fmt"
 	"net/http"
-	"regexp"
 	"strings"
 )
 
 const (
-	headerKey = "Authorization"
-	basicKey  = "Basic "
-	bearerKey = "Bearer "
-	tokenKey  = "Token "
+	headerKey      = "Authorization"
+	proxyHeaderKey = "Proxy-Authorization"
+	basicKey       = "Basic "
+	bearerKey      = "Bearer "
+	tokenKey       = "Token "
 )
 
-func getTokenFromRequest(req *http.Request) (string, error) {
-	headerValue := req.Header.Get(headerKey)
-	if headerValue == "" {
-		return "", fmt.Errorf("Header %s not found in request", headerKey)
+var (
+	// ErrNoCredentials is returned when the request does not contain any credentials.
+	ErrNoCredentials = errors.New("no credentials in request")
+	// ErrUnsupportedScheme is returned when the authorization scheme is unknown.
+	ErrUnsupportedScheme = errors.New("unsupported authorization scheme")
+	// ErrInvalidEncoding is returned when basic credentials are not valid base64.
+	ErrInvalidEncoding = errors.New("invalid basic credentials encoding")
+	// ErrEmptyCredentials is returned when the credentials do not contain a token.
+	ErrEmptyCredentials = errors.New("username component and password component cannot be empty")
+)
+
+// CredentialError is returned when credentials are present in a request but cannot be parsed.
+type CredentialError struct {
+	Header string
+	Err    error
+}
+
+func (e *CredentialError) Error() string {
+	return fmt.Sprintf("invalid %s header: %v", e.Header, e.Err)
+}
+
+func (e *CredentialError) Unwrap() error {
+	return e.Err
+}
+
+// Credentials are the client credentials extracted from a request.
+type Credentials struct {
+	Username string
+	Token    string
+	// PolicyID is set when the username is used to select the policy.
+	PolicyID string
+}
+
+// CredentialExtractor extracts client credentials from a request. It returns ErrNoCredentials
+// if the request does not contain credentials it understands, and a *CredentialError if the
+// credentials are malformed.
+type CredentialExtractor interface {
+	Extract(req *http.Request) (*Credentials, error)
+}
+
+// ExtractorChain tries each extractor in order and returns the first credentials found.
+type ExtractorChain []CredentialExtractor
+
+func (c ExtractorChain) Extract(req *http.Request) (*Credentials, error) {
+	for _, extractor := range c {
+		creds, err := extractor.Extract(req)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return creds, err
 	}
-	encodedToken, isBearer, err := extractEncodedToken(headerValue)
-	if err != nil {
-		return "", err
+	return nil, ErrNoCredentials
+}
+
+// NewCredentialExtractor returns the default extractor chain which reads Basic, Bearer and Token
+// credentials from the Authorization header followed by the Proxy-Authorization header.
+func NewCredentialExtractor(usernameAsPolicyID bool) CredentialExtractor {
+	return ExtractorChain{
+		&HeaderExtractor{Header: headerKey, UsernameAsPolicyID: usernameAsPolicyID},
+		&HeaderExtractor{Header: proxyHeaderKey, UsernameAsPolicyID: usernameAsPolicyID},
 	}
-	if isBearer {
-		return encodedToken, nil
+}
+
+// HeaderExtractor extracts credentials from an authorization header.
+type HeaderExtractor struct {
+	Header string
+	// UsernameAsPolicyID treats the username of Basic credentials as the policy ID when both
+	// username and password are set. Only the token hash of that policy is then checked.
+	UsernameAsPolicyID bool
+}
+
+func (h *HeaderExtractor) Extract(req *http.Request) (*Credentials, error) {
+	headerValue := strings.TrimSpace(req.Header.Get(h.Header))
+	if headerValue == "" {
+		return nil, ErrNoCredentials
 	}
-	decodedToken, err := b64.URLEncoding.DecodeString(encodedToken)
-	if err != nil {
-		return "", err
+	scheme, value, _ := strings.Cut(headerValue, " ")
+	value = strings.TrimSpace(value)
+	switch {
+	case strings.EqualFold(scheme, strings.TrimSpace(basicKey)):
+		creds, err := h.parseBasic(value)
+		if err != nil {
+			return nil, &CredentialError{Header: h.Header, Err: err}
+		}
+		return creds, nil
+	case strings.EqualFold(scheme, strings.TrimSpace(bearerKey)), strings.EqualFold(scheme, strings.TrimSpace(tokenKey)):
+		if value == "" {
+			return nil, &CredentialError{Header: h.Header, Err: ErrEmptyCredentials}
+		}
+		return &Credentials{Token: value}, nil
+	default:
+		return nil, &CredentialError{Header: h.Header, Err: ErrUnsupportedScheme}
 	}
-	comps := strings.Split(string(decodedToken), ":")
-	if len(comps) != 2 {
-		return "", fmt.Errorf("decoded token does not contain enough components")
+}
+
+func (h *HeaderExtractor) parseBasic(value string) (*Credentials, error) {
+	decoded, err := decodeBase64(value)
+	if err != nil {
+		return nil, err
 	}
-	if comps[1] != "" {
-		return comps[1], nil
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing separator", ErrInvalidEncoding)
 	}
-	if comps[0] != "" {
-		return comps[0], nil
+	switch {
+	case username != "" && password != "":
+		creds := &Credentials{Username: username, Token: password}
+		if h.UsernameAsPolicyID {
+			creds.PolicyID = username
+		}
+		return creds, nil
+	case password != "":
+		return &Credentials{Token: password}, nil
+	case username != "":
+		return &Credentials{Token: username}, nil
+	default:
+		return nil, ErrEmptyCredentials
 	}
-	return "", fmt.Errorf("username component and password component cannot be empty")
 }
 
-func extractEncodedToken(value string) (string, bool, error) {
-	var re = regexp.MustCompile(`(?i)^\s*(Basic) `)
-	if re.MatchString(value) {
-		token := re.ReplaceAllString(value, "")
-		return token, false, nil
-	}
-	re = regexp.MustCompile(`(?i)^\s*(Basic|Bearer|Token) `)
-	if re.MatchString(value) {
-		token := re.ReplaceAllString(value, "")
-		return token, true, nil
+// decodeBase64 decodes the standard alphabet used by git and curl. The URL alphabet is
+// accepted as well for backwards compatibility with clients encoding credentials with it.
+func decodeBase64(value string) ([]byte, error) {
+	for _, enc := range []*b64.Encoding{b64.StdEncoding, b64.URLEncoding, b64.RawStdEncoding, b64.RawURLEncoding} {
+		decoded, err := enc.DecodeString(value)
+		if err == nil {
+			return decoded, nil
+		}
 	}
-	return "", false, fmt.Errorf("Missing either %s, %s or %s", basicKey, bearerKey, tokenKey)
+	return nil, ErrInvalidEncoding
 }
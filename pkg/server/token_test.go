@@ -11,11 +11,13 @@ import (
 
 func TestBasic(t *testing.T) {
 	tests := []struct {
-		name     string
-		key      string
-		username string
-		password string
-		expected string
+		name               string
+		key                string
+		username           string
+		password           string
+		usernameAsPolicyID bool
+		expected           string
+		expectedPolicyID   string
 	}{
 		{
 			name:     "basic only username",
@@ -38,25 +40,128 @@ func TestBasic(t *testing.T) {
 			password: "bar",
 			expected: "bar",
 		},
+		{
+			name:     "basic password with separator",
+			key:      basicKey,
+			username: "foo",
+			password: "bar:baz",
+			expected: "bar:baz",
+		},
+		{
+			name:     "basic lower case scheme",
+			key:      "basic ",
+			username: "foo",
+			password: "bar",
+			expected: "bar",
+		},
+		{
+			name:               "basic username as policy id",
+			key:                basicKey,
+			username:           "foo",
+			password:           "bar",
+			usernameAsPolicyID: true,
+			expected:           "bar",
+			expectedPolicyID:   "foo",
+		},
+		{
+			name:               "basic only username as policy id",
+			key:                basicKey,
+			username:           "foo",
+			password:           "",
+			usernameAsPolicyID: true,
+			expected:           "foo",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			req := &http.Request{Header: http.Header{}}
 			combo := fmt.Sprintf("%s:%s", tt.username, tt.password)
-			headerValue := fmt.Sprintf("%s%s", tt.key, b64.URLEncoding.EncodeToString([]byte(combo)))
+			headerValue := fmt.Sprintf("%s%s", tt.key, b64.StdEncoding.EncodeToString([]byte(combo)))
 			req.Header.Set(headerKey, headerValue)
-			token, err := getTokenFromRequest(req)
+			creds, err := NewCredentialExtractor(tt.usernameAsPolicyID).Extract(req)
 			require.NoError(t, err)
-			require.Equal(t, tt.expected, token)
+			require.Equal(t, tt.expected, creds.Token)
+			require.Equal(t, tt.expectedPolicyID, creds.PolicyID)
 		})
 	}
 }
 
+func TestBasicEncoding(t *testing.T) {
+	// The token encodes to characters which differ between the standard and URL alphabets.
+	combo := "x-access-token:??>>"
+	for _, enc := range []*b64.Encoding{b64.StdEncoding, b64.URLEncoding} {
+		req := &http.Request{Header: http.Header{}}
+		req.Header.Set(headerKey, basicKey+enc.EncodeToString([]byte(combo)))
+		creds, err := NewCredentialExtractor(false).Extract(req)
+		require.NoError(t, err)
+		require.Equal(t, "??>>", creds.Token)
+	}
+}
+
 func TestBearer(t *testing.T) {
+	for _, key := range []string{bearerKey, tokenKey} {
+		req := &http.Request{Header: http.Header{}}
+		headerValue := fmt.Sprintf("%s%s", key, "token")
+		req.Header.Set(headerKey, headerValue)
+		creds, err := NewCredentialExtractor(false).Extract(req)
+		require.NoError(t, err)
+		require.Equal(t, "token", creds.Token)
+	}
+}
+
+func TestProxyAuthorization(t *testing.T) {
 	req := &http.Request{Header: http.Header{}}
-	headerValue := fmt.Sprintf("%s%s", bearerKey, "token")
-	req.Header.Set(headerKey, headerValue)
-	token, err := getTokenFromRequest(req)
+	req.Header.Set(proxyHeaderKey, basicKey+b64.StdEncoding.EncodeToString([]byte("foo:bar")))
+	creds, err := NewCredentialExtractor(false).Extract(req)
 	require.NoError(t, err)
-	require.Equal(t, "token", token)
+	require.Equal(t, "bar", creds.Token)
+}
+
+func TestInvalidCredentials(t *testing.T) {
+	tests := []struct {
+		name        string
+		headerValue string
+		expected    error
+	}{
+		{
+			name:        "no credentials",
+			headerValue: "",
+			expected:    ErrNoCredentials,
+		},
+		{
+			name:        "unsupported scheme",
+			headerValue: "Digest foo",
+			expected:    ErrUnsupportedScheme,
+		},
+		{
+			name:        "invalid base64",
+			headerValue: basicKey + "!!!",
+			expected:    ErrInvalidEncoding,
+		},
+		{
+			name:        "missing separator",
+			headerValue: basicKey + b64.StdEncoding.EncodeToString([]byte("foo")),
+			expected:    ErrInvalidEncoding,
+		},
+		{
+			name:        "empty basic",
+			headerValue: basicKey + b64.StdEncoding.EncodeToString([]byte(":")),
+			expected:    ErrEmptyCredentials,
+		},
+		{
+			name:        "empty bearer",
+			headerValue: bearerKey,
+			expected:    ErrEmptyCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header{}}
+			if tt.headerValue != "" {
+				req.Header.Set(headerKey, tt.headerValue)
+			}
+			_, err := NewCredentialExtractor(false).Extract(req)
+			require.ErrorIs(t, err, tt.expected)
+		})
+	}
 }
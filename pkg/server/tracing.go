@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/legobeat/git-auth-proxy/pkg/audit"
+)
+
+var tracer = otel.Tracer("github.com/legobeat/git-auth-proxy/pkg/server")
+
+// startServerSpan starts the span of the proxied request as a child of the trace context sent by the client.
+func startServerSpan(c *gin.Context) trace.Span {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracer.Start(ctx, "proxy", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", c.Request.Method),
+		attribute.String("url.path", c.Request.URL.Path),
+	))
+	c.Request = c.Request.WithContext(ctx)
+	return span
+}
+
+// endServerSpan ends the span of the proxied request with the outcome recorded in the audit event.
+func endServerSpan(c *gin.Context, span trace.Span, event *audit.Event) {
+	span.SetAttributes(
+		attribute.String("policy", event.Policy),
+		attribute.String("decision", event.Decision),
+		attribute.String("reason", event.Reason),
+		attribute.String("service", event.Service),
+		attribute.String("repository", event.Repository),
+		attribute.Int("http.response.status_code", c.Writer.Status()),
+	)
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(c.Writer.Status()))
+	}
+	span.End()
+}
+
+// startClientSpan starts the span of an upstream request and propagates its trace context upstream.
+// Baggage of the client is not sent upstream. The request is cloned so that the caller's request is not modified.
+func startClientSpan(req *http.Request) (*http.Request, trace.Span) {
+	ctx, span := tracer.Start(req.Context(), "upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("http.request.method", req.Method),
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("url.path", req.URL.Path),
+	))
+	req = req.Clone(ctx)
+	req.Header.Del("Baggage")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	return req, span
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestProxyHandlerTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceparent := atomic.Value{}
+	baggage := atomic.Value{}
+	upstream := func(w http.ResponseWriter, r *http.Request) {
+		traceparent.Store(r.Header.Get("traceparent"))
+		baggage.Store(r.Header.Get("baggage"))
+		w.WriteHeader(http.StatusOK)
+	}
+	proxyURL := newTestProxy(t, upstream, nil)
+
+	req, err := http.NewRequest(http.MethodGet, proxyURL+"/org/repo.git/info/refs?service=git-upload-pack", nil)
+	require.NoError(t, err)
+	req.Header.Set(headerKey, basicAuth("user", "incoming-test-token"))
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set("baggage", "user=alice")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The upstream receives the trace of the client with the upstream span as parent
+	upstreamTraceparent, ok := traceparent.Load().(string)
+	require.True(t, ok)
+	require.Regexp(t, "^00-0af7651916cd43dd8448eb211c80319c-[0-9a-f]{16}-01$", upstreamTraceparent)
+	require.NotContains(t, upstreamTraceparent, "b7ad6b7169203331")
+	require.Equal(t, "", baggage.Load())
+
+	require.Eventually(t, func() bool {
+		for _, span := range recorder.Ended() {
+			if span.Name() == "proxy" {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 10*time.Millisecond)
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		require.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.SpanContext().TraceID().String())
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"proxy", "Authorize", "CheckTokenHash", "UpdateRequest", "Token", "upstream"} {
+		require.Contains(t, spans, name)
+	}
+	require.Equal(t, "b7ad6b7169203331", spans["proxy"].Parent().SpanID().String())
+	require.Equal(t, spans["proxy"].SpanContext().SpanID(), spans["upstream"].Parent().SpanID())
+	require.Contains(t, upstreamTraceparent, spans["upstream"].SpanContext().SpanID().String())
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+// TransportConfig configures the transport shared by all upstream requests.
+type TransportConfig struct {
+	// MaxIdleConns is the maximum number of idle connections across all upstreams.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept per upstream host.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the number of connections per upstream host, zero is unlimited.
+	MaxConnsPerHost int
+	// IdleConnTimeout is the duration after which idle connections are closed.
+	IdleConnTimeout time.Duration
+	// KeepAlive is the interval of TCP keep-alive probes, a negative value disables keep-alives.
+	KeepAlive time.Duration
+	// DialTimeout is the timeout for establishing TCP connections.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout is the timeout for TLS handshakes.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout is the timeout for receiving the response headers after the request has been sent, zero is no timeout.
+	ResponseHeaderTimeout time.Duration
+	// HTTP2 attempts to use HTTP/2 for upstream connections.
+	HTTP2 bool
+	// BufferSize is the size of the pooled buffers used to copy response bodies.
+	BufferSize int
+}
+
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   100,
+		MaxConnsPerHost:       0,
+		IdleConnTimeout:       90 * time.Second,
+		KeepAlive:             30 * time.Second,
+		DialTimeout:           30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 0,
+		HTTP2:                 true,
+		BufferSize:            32 * 1024,
+	}
+}
+
+// NewTransport returns a transport for upstream requests. Proxy settings are read from the environment.
+func NewTransport(cfg TransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: cfg.KeepAlive,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     cfg.HTTP2,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		DisableKeepAlives:     cfg.KeepAlive < 0,
+	}
+}
+
+// bufferPool shares the buffers used by the reverse proxies to copy bodies.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() any {
+				b := make([]byte, size)
+				return &b
+			},
+		},
+	}
+}
+
+func (p *bufferPool) Get() []byte {
+	b, ok := p.pool.Get().(*[]byte)
+	if !ok {
+		return nil
+	}
+	return *b
+}
+
+func (p *bufferPool) Put(b []byte) {
+	p.pool.Put(&b)
+}
+
+type proxyKey struct {
+	target    string
+	transport http.RoundTripper
+}
+
+// proxyCache keeps a long lived reverse proxy per upstream and transport.
+type proxyCache struct {
+	newProxy func(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy
+
+	mu      sync.Mutex
+	proxies map[proxyKey]*httputil.ReverseProxy
+}
+
+func newProxyCache(newProxy func(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy) *proxyCache {
+	return &proxyCache{
+		newProxy: newProxy,
+		proxies:  map[proxyKey]*httputil.ReverseProxy{},
+	}
+}
+
+func (p *proxyCache) get(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	key := proxyKey{target: target.String(), transport: transport}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	proxy, ok := p.proxies[key]
+	if !ok {
+		proxy = p.newProxy(target, transport)
+		p.proxies[key] = proxy
+	}
+	return proxy
+}
+
+// newUpstreamTransport returns a transport for the upstream settings of a policy, derived from the shared transport.
+func newUpstreamTransport(base *http.Transport, upstream *config.Upstream) (*http.Transport, error) {
+	transport := base.Clone()
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		//nolint: gosec // explicitly configured for test environments
+		InsecureSkipVerify: upstream.InsecureSkipVerify,
+	}
+	if upstream.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		b, err := os.ReadFile(upstream.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read upstream CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in upstream CA bundle %s", upstream.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if upstream.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(upstream.CertFile, upstream.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load upstream client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsCfg
+	if upstream.Proxy != "" {
+		proxyURL, err := url.Parse(upstream.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream proxy: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport, nil
+}
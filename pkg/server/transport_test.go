@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+func TestProxyCache(t *testing.T) {
+	created := 0
+	cache := newProxyCache(func(target *url.URL, _ http.RoundTripper) *httputil.ReverseProxy {
+		created++
+		return httputil.NewSingleHostReverseProxy(target)
+	})
+	github, err := url.Parse("https://github.com")
+	require.NoError(t, err)
+	api, err := url.Parse("https://api.github.com")
+	require.NoError(t, err)
+
+	transport := NewTransport(DefaultTransportConfig())
+	otherTransport := NewTransport(DefaultTransportConfig())
+	require.Same(t, cache.get(github, transport), cache.get(github, transport))
+	require.NotSame(t, cache.get(github, transport), cache.get(api, transport))
+	require.NotSame(t, cache.get(github, transport), cache.get(github, otherTransport))
+	require.Equal(t, 3, created)
+}
+
+// newBenchmarkUpstream starts a TLS upstream which counts the connections, and therefore TLS handshakes, made to it.
+func newBenchmarkUpstream(b *testing.B) (*url.URL, *tls.Config, *atomic.Int64) {
+	b.Helper()
+
+	handshakes := &atomic.Int64{}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		//nolint: errcheck //ignore
+		w.Write([]byte("0008NAK\n0000"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			handshakes.Add(1)
+		}
+	}
+	srv.StartTLS()
+	b.Cleanup(srv.Close)
+	target, err := url.Parse(srv.URL)
+	require.NoError(b, err)
+	return target, srv.Client().Transport.(*http.Transport).TLSClientConfig, handshakes
+}
+
+// fetch emulates the round trips of a git fetch through the handler.
+func fetch(b *testing.B, handler func() http.Handler, target *url.URL) {
+	b.Helper()
+
+	for _, path := range []string{"/org/repo/info/refs", "/org/repo/git-upload-pack", "/org/repo/git-upload-pack"} {
+		req := httptest.NewRequest(http.MethodGet, target.String()+path, nil)
+		rec := httptest.NewRecorder()
+		handler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			b.Errorf("unexpected status %d", rec.Code)
+			return
+		}
+	}
+}
+
+func BenchmarkProxy(b *testing.B) {
+	// The baseline creates a reverse proxy for every request on a single transport, as the proxy did before
+	// proxies were cached. Connections are reused in both cases, the difference is in the allocations.
+	b.Run("PerRequestProxy", func(b *testing.B) {
+		target, tlsCfg, handshakes := newBenchmarkUpstream(b)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsCfg
+		b.ReportAllocs()
+		b.SetParallelism(8)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				fetch(b, func() http.Handler {
+					proxy := httputil.NewSingleHostReverseProxy(target)
+					proxy.Transport = transport
+					return proxy
+				}, target)
+			}
+		})
+		b.ReportMetric(float64(handshakes.Load())/float64(b.N), "handshakes/op")
+	})
+	b.Run("SharedProxy", func(b *testing.B) {
+		target, tlsCfg, handshakes := newBenchmarkUpstream(b)
+		transport := NewTransport(DefaultTransportConfig())
+		transport.TLSClientConfig = tlsCfg
+		pool := newBufferPool(DefaultTransportConfig().BufferSize)
+		cache := newProxyCache(func(target *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.Transport = transport
+			proxy.BufferPool = pool
+			return proxy
+		})
+		b.ReportAllocs()
+		b.SetParallelism(8)
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				fetch(b, func() http.Handler {
+					return cache.get(target, transport)
+				}, target)
+			}
+		})
+		b.ReportMetric(float64(handshakes.Load())/float64(b.N), "handshakes/op")
+	})
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	require.NoError(t, err)
+	base := NewTransport(DefaultTransportConfig())
+
+	tests := []struct {
+		name     string
+		upstream *config.Upstream
+		valid    bool
+	}{
+		{
+			name:     "untrusted upstream",
+			upstream: &config.Upstream{},
+			valid:    false,
+		},
+		{
+			name:     "upstream ca bundle",
+			upstream: &config.Upstream{CAFile: caFile},
+			valid:    true,
+		},
+		{
+			name:     "insecure skip verify",
+			upstream: &config.Upstream{InsecureSkipVerify: true},
+			valid:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport, err := newUpstreamTransport(base, tt.upstream)
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			require.NoError(t, err)
+			resp, err := transport.RoundTrip(req)
+			if !tt.valid {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestUpstreamTransportProxy(t *testing.T) {
+	transport, err := newUpstreamTransport(NewTransport(DefaultTransportConfig()), &config.Upstream{Proxy: "http://proxy.example.com:3128"})
+	require.NoError(t, err)
+	req, err := http.NewRequest(http.MethodGet, "https://github.com", nil)
+	require.NoError(t, err)
+	proxyURL, err := transport.Proxy(req)
+	require.NoError(t, err)
+	require.Equal(t, "http://proxy.example.com:3128", proxyURL.String())
+}
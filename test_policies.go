@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/afero"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+	"github.com/legobeat/git-auth-proxy/pkg/policytest"
+)
+
+type TestPoliciesCommand struct {
+	JUnit string   `arg:"--junit" help:"path to write a JUnit XML report to"`
+	Files []string `arg:"positional,required" help:"YAML or JSON files of test cases"`
+}
+
+// testPolicies runs the test cases against the configuration and returns the exit code.
+func testPolicies(w io.Writer, fs afero.Fs, path string, cmd *TestPoliciesCommand) int {
+	b := &strings.Builder{}
+	ok, err := runPolicyTests(b, fs, path, cmd)
+	if err != nil {
+		fmt.Fprintf(b, "error: %v\n", err)
+	}
+	//nolint: errcheck //ignore
+	io.WriteString(w, b.String())
+	if err != nil || !ok {
+		return 1
+	}
+	return 0
+}
+
+func runPolicyTests(b *strings.Builder, fs afero.Fs, path string, cmd *TestPoliciesCommand) (bool, error) {
+	cfg, err := config.LoadConfiguration(fs, path, config.WithoutSecrets())
+	if err != nil {
+		return false, fmt.Errorf("could not load configuration: %w", err)
+	}
+	authz, err := auth.NewAuthorizer(cfg)
+	if err != nil {
+		return false, fmt.Errorf("could not generate authorization: %w", err)
+	}
+	suites := []*policytest.Suite{}
+	for _, file := range cmd.Files {
+		suite, err := policytest.LoadSuite(fs, file)
+		if err != nil {
+			return false, err
+		}
+		suites = append(suites, suite)
+	}
+
+	ok := true
+	passed, total := 0, 0
+	results := [][]policytest.Result{}
+	for _, suite := range suites {
+		suiteResults := policytest.Run(authz, suite)
+		for _, r := range suiteResults {
+			total++
+			switch {
+			case r.Err != nil:
+				ok = false
+				fmt.Fprintf(b, "ERROR %s: %s: %v\n", suite.Name, r.Case.Name, r.Err)
+			case !r.Passed:
+				ok = false
+				fmt.Fprintf(b, "FAIL  %s: %s: expected %s: %s\n", suite.Name, r.Case.Name, r.Case.Expect, r.Message)
+			default:
+				passed++
+				fmt.Fprintf(b, "PASS  %s: %s\n", suite.Name, r.Case.Name)
+			}
+		}
+		results = append(results, suiteResults)
+	}
+	fmt.Fprintf(b, "%d of %d test cases passed\n", passed, total)
+
+	if cmd.JUnit != "" {
+		f, err := fs.Create(cmd.JUnit)
+		if err != nil {
+			return false, fmt.Errorf("could not create JUnit report: %w", err)
+		}
+		//nolint: errcheck //ignore
+		defer f.Close()
+		if err := policytest.WriteJUnit(f, suites, results); err != nil {
+			return false, fmt.Errorf("could not write JUnit report: %w", err)
+		}
+	}
+	return ok, nil
+}
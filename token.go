@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/legobeat/git-auth-proxy/pkg/auth"
+	"github.com/legobeat/git-auth-proxy/pkg/config"
+)
+
+type TokenCommand struct {
+	New    *TokenNewCommand    `arg:"subcommand:new" help:"generate a client token and its token hash"`
+	Verify *TokenVerifyCommand `arg:"subcommand:verify" help:"check a client token against a token hash"`
+}
+
+type TokenNewCommand struct {
+	Algorithm string `arg:"--algorithm" default:"argon2id" help:"hash algorithm, one of argon2id, bcrypt and sha512crypt"`
+}
+
+type TokenVerifyCommand struct {
+	Hash  string `arg:"--hash,required" help:"token hash to check the token against"`
+	Token string `arg:"--token,env:GIT_AUTH_PROXY_TOKEN" help:"client token to check, read from stdin if empty"`
+}
+
+// token runs the token subcommand and returns the exit code.
+func token(r io.Reader, w io.Writer, cmd *TokenCommand) int {
+	b := &strings.Builder{}
+	var err error
+	switch {
+	case cmd.New != nil:
+		err = newToken(b, cmd.New)
+	case cmd.Verify != nil:
+		err = verifyToken(r, b, cmd.Verify)
+	default:
+		err = errors.New("either new or verify is required")
+	}
+	if err != nil {
+		fmt.Fprintf(b, "error: %v\n", err)
+	}
+	//nolint: errcheck //ignore
+	io.WriteString(w, b.String())
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+// newToken writes a new client token and the user auth of a policy with its token hash.
+func newToken(b *strings.Builder, cmd *TokenNewCommand) error {
+	if !slices.Contains(auth.HashAlgorithms, cmd.Algorithm) {
+		return fmt.Errorf("unsupported hash algorithm %s", cmd.Algorithm)
+	}
+	token, err := auth.NewToken()
+	if err != nil {
+		return fmt.Errorf("could not generate token: %w", err)
+	}
+	tokenHash, err := auth.HashToken(token, cmd.Algorithm)
+	if err != nil {
+		return fmt.Errorf("could not hash token: %w", err)
+	}
+	snippet, err := json.MarshalIndent(map[string]config.UserAuth{"userAuth": {TokenHash: tokenHash}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(b, "token: %s\n\nThe token is only shown once. Add the token hash to the policy:\n\n%s\n", token, snippet)
+	return nil
+}
+
+// verifyToken returns an error if the token does not match the hash.
+func verifyToken(r io.Reader, b *strings.Builder, cmd *TokenVerifyCommand) error {
+	token := cmd.Token
+	if token == "" {
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("could not read token: %w", err)
+		}
+		token = strings.TrimRight(line, "\r\n")
+	}
+	if token == "" {
+		return errors.New("token is empty")
+	}
+	valid, err := auth.CheckTokenHash(token, cmd.Hash)
+	if err != nil {
+		return fmt.Errorf("could not check token hash: %w", err)
+	}
+	if !valid {
+		return errors.New("token does not match the token hash")
+	}
+	b.WriteString("token matches the token hash\n")
+	return nil
+}